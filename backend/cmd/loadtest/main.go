@@ -0,0 +1,469 @@
+// Command loadtest drives many concurrent rooms of bot players against a
+// game server and reports game_state throughput and tick jitter.
+//
+// By default it starts an in-process hub on a loopback port, so
+//
+//	go run ./cmd/loadtest -rooms 300 -players 4
+//
+// measures the room loop on its own; pass -url to load a running server.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fps-backend/internal/game"
+	"fps-backend/internal/ws"
+)
+
+type stats struct {
+	states  atomic.Int64
+	inputs  atomic.Int64
+	errors  atomic.Int64
+	mu      sync.Mutex
+	jitters []time.Duration
+
+	// stateBytes is the size of the counted states
+	stateBytes atomic.Int64
+}
+
+func (s *stats) addGaps(gaps []time.Duration) {
+	s.mu.Lock()
+	s.jitters = append(s.jitters, gaps...)
+	s.mu.Unlock()
+}
+
+func main() {
+	url := flag.String("url", "", "ws:// URL of a running server, whose -max-conns-per-ip must allow every bot (empty: start an in-process hub)")
+	rooms := flag.Int("rooms", 200, "number of concurrent rooms")
+	players := flag.Int("players", 2, "bots per room")
+	duration := flag.Duration("duration", 10*time.Second, "how long to measure once all matches are running")
+	tickRate := flag.Int("tick", 20, "tick rate for the in-process hub (Hz)")
+	inputRate := flag.Int("input-rate", 20, "inputs per second sent by each bot")
+	binary := flag.Bool("binary", false, "negotiate the bin.v1 encoding")
+	delta := flag.Bool("delta", false, "negotiate delta.v1 snapshots and ack every one")
+	compress := flag.Bool("compress", false, "negotiate permessage-deflate")
+	setupParallel := flag.Int("setup-parallel", 16, "rooms being created at the same time")
+	flag.Parse()
+
+	if *rooms <= 0 || *players <= 0 {
+		log.Fatal("rooms and players must be positive")
+	}
+	var hub *game.Hub
+	if *url == "" {
+		var addr string
+		var err error
+		hub, addr, err = serveHub(time.Second / time.Duration(*tickRate))
+		if err != nil {
+			log.Fatal(err)
+		}
+		*url = "ws://" + addr + "/ws"
+	}
+
+	opts := ws.DialOptions{
+		Subprotocols: []string{game.Subprotocol},
+		Compression:  ws.CompressionOptions{Enabled: *compress},
+	}
+	var caps []string
+	if *binary {
+		caps = append(caps, game.CapBinaryV1)
+	}
+	if *delta {
+		caps = append(caps, game.CapDeltaV1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var st stats
+	var ready, wg sync.WaitGroup
+	measure := make(chan struct{})
+	// Bots in the lobby receive every room list broadcast; bounding how
+	// many rooms are set up at once keeps that traffic out of the result.
+	setup := make(chan struct{}, max(*setupParallel, 1))
+	setupStart := time.Now()
+	for i := 0; i < *rooms; i++ {
+		ready.Add(1)
+		wg.Add(1)
+		onReady := sync.OnceFunc(ready.Done)
+		go func(i int) {
+			defer wg.Done()
+			b := &roomBots{
+				url:     *url,
+				opts:    opts,
+				caps:    caps,
+				name:    fmt.Sprintf("load-%d", i),
+				players: *players,
+				input:   time.Second / time.Duration(*inputRate),
+				stats:   &st,
+			}
+			setup <- struct{}{}
+			release := sync.OnceFunc(func() { <-setup })
+			defer release()
+			ready := func() {
+				release()
+				onReady()
+			}
+			if err := b.run(ctx, ready, measure); err != nil {
+				st.errors.Add(1)
+				log.Printf("room %d: %v", i, err)
+			}
+		}(i)
+	}
+	ready.Wait()
+	log.Printf("%d rooms x %d players running after %v", *rooms, *players, time.Since(setupStart).Round(time.Millisecond))
+
+	st.states.Store(0)
+	st.stateBytes.Store(0)
+	st.inputs.Store(0)
+	close(measure)
+	begin := time.Now()
+	time.Sleep(*duration)
+	elapsed := time.Since(begin)
+	states, stateBytes, inputs := st.states.Load(), st.stateBytes.Load(), st.inputs.Load()
+	cancel()
+	wg.Wait()
+
+	secs := elapsed.Seconds()
+	conns := *rooms * *players
+	fmt.Printf("connections      %d\n", conns)
+	fmt.Printf("inputs sent      %.0f/s\n", float64(inputs)/secs)
+	fmt.Printf("game_state recv  %.0f/s (%.1f/s per client, tick %d Hz)\n", float64(states)/secs, float64(states)/secs/float64(conns), *tickRate)
+	if states > 0 {
+		fmt.Printf("game_state size  %.0f bytes avg (%.1f KB/s per client, before compression)\n",
+			float64(stateBytes)/float64(states), float64(stateBytes)/secs/float64(conns)/1024)
+	}
+	st.mu.Lock()
+	j := st.jitters
+	st.mu.Unlock()
+	if len(j) > 0 {
+		slices.Sort(j)
+		fmt.Printf("state interval   p50 %v  p99 %v  max %v\n", pct(j, 0.50), pct(j, 0.99), j[len(j)-1])
+	}
+	if hub != nil {
+		s := hub.Stats()
+		fmt.Printf("server queues    %d snapshots coalesced, %d slow consumers dropped\n", s.Coalesced, s.SlowConsumers)
+		fmt.Printf("rate limited     %d messages\n", s.RateLimited)
+	}
+	if n := st.errors.Load(); n > 0 {
+		fmt.Printf("failed rooms     %d\n", n)
+		os.Exit(1)
+	}
+}
+
+func pct(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)].Round(100 * time.Microsecond)
+}
+
+// serveHub starts a hub on a loopback port and returns its address.
+func serveHub(tick time.Duration) (*game.Hub, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	hub := game.NewHub(game.Config{
+		Tick: tick,
+		// every bot connects from 127.0.0.1
+		MaxConnsPerIP: -1,
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/ws", hub)
+	go func() { _ = http.Serve(ln, mux) }()
+	return hub, ln.Addr().String(), nil
+}
+
+// roomBots plays one room: the first bot creates and starts it, the others
+// join, then every bot streams inputs and counts game_state messages.
+type roomBots struct {
+	url     string
+	opts    ws.DialOptions
+	caps    []string
+	name    string
+	players int
+	input   time.Duration
+	stats   *stats
+}
+
+const setupTimeout = 10 * time.Second
+
+var (
+	stateMsgPrefix = []byte(`{"type":"game_state"`)
+	deltaMsgPrefix = []byte(`{"type":"game_delta"`)
+)
+
+// bot is one connection. Its reader runs from the handshake on, so the
+// server never sees a stalled consumer; setup replies arrive on ctrl.
+type bot struct {
+	c     *ws.Conn
+	ctrl  chan game.Envelope
+	errc  chan error
+	count atomic.Bool
+}
+
+// run calls ready once the match is running (or setup failed) and starts
+// counting when measure is closed.
+func (b *roomBots) run(ctx context.Context, ready func(), measure <-chan struct{}) error {
+	defer ready()
+	setupCtx, cancelSetup := context.WithTimeout(ctx, setupTimeout)
+	defer cancelSetup()
+	bots := make([]*bot, 0, b.players)
+	var readers sync.WaitGroup
+	defer func() {
+		for _, bt := range bots {
+			_ = bt.c.CloseWithStatus(ws.CloseNormalClosure, "", time.Second)
+		}
+		readers.Wait()
+	}()
+	for i := 0; i < b.players; i++ {
+		c, _, err := ws.Dial(setupCtx, b.url, b.opts)
+		if err != nil {
+			return err
+		}
+		bt := &bot{c: c, ctrl: make(chan game.Envelope, 16), errc: make(chan error, 1)}
+		bots = append(bots, bt)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			b.read(ctx, bt)
+		}()
+		if err := send(c, "hello", game.HelloReq{
+			Name:    fmt.Sprintf("%s-%d", b.name, i),
+			Version: game.ProtocolVersion,
+			Caps:    b.caps,
+		}); err != nil {
+			return err
+		}
+		if _, err := bt.expect(setupCtx, "hello_ack"); err != nil {
+			return err
+		}
+	}
+
+	host := bots[0]
+	if err := send(host.c, "room_create", game.RoomCreateReq{Name: b.name}); err != nil {
+		return err
+	}
+	env, err := host.expect(setupCtx, "room_state")
+	if err != nil {
+		return err
+	}
+	var rs game.RoomState
+	if err := json.Unmarshal(env.Payload, &rs); err != nil {
+		return err
+	}
+	for _, bt := range bots[1:] {
+		if err := send(bt.c, "room_join", game.RoomJoinReq{RoomID: rs.ID}); err != nil {
+			return err
+		}
+		if _, err := bt.expect(setupCtx, "room_state"); err != nil {
+			return err
+		}
+	}
+	for _, bt := range bots {
+		if err := send(bt.c, "room_ready", game.RoomReadyReq{Ready: true}); err != nil {
+			return err
+		}
+	}
+	// Ready messages from other bots race the start request; retry until
+	// the room accepts it.
+	winScore := 50
+	for {
+		if err := send(host.c, "room_start", game.RoomStartReq{WinScore: &winScore}); err != nil {
+			return err
+		}
+		env, err := host.expect(setupCtx, "game_start", "error")
+		if err != nil {
+			return err
+		}
+		if env.Type == "game_start" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ready()
+	select {
+	case <-measure:
+	case <-ctx.Done():
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(bots))
+	for _, bt := range bots {
+		bt.count.Store(true)
+		wg.Add(1)
+		go func(c *ws.Conn) {
+			defer wg.Done()
+			errs <- b.sendInputs(ctx, c)
+		}(bt.c)
+	}
+	for _, bt := range bots {
+		select {
+		case err := <-bt.errc:
+			return err
+		case <-ctx.Done():
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read consumes every server message, counting game_state while bt.count
+// is set and handing the rest to setup via bt.ctrl.
+func (b *roomBots) read(ctx context.Context, bt *bot) {
+	var gaps []time.Duration
+	defer func() { b.stats.addGaps(gaps) }()
+	var last time.Time
+	for {
+		typ, data, err := bt.c.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				bt.errc <- err
+			}
+			return
+		}
+		// Envelopes marshal "type" first, so a prefix check skips decoding
+		// the bulk of the traffic.
+		isState := typ == ws.BinaryMessage || bytes.HasPrefix(data, stateMsgPrefix) || bytes.HasPrefix(data, deltaMsgPrefix)
+		if isState && slices.Contains(b.caps, game.CapDeltaV1) {
+			if err := ackState(bt.c, typ, data); err != nil {
+				if ctx.Err() == nil {
+					bt.errc <- err
+				}
+				return
+			}
+		}
+		if !isState {
+			var env game.Envelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				bt.errc <- err
+				return
+			}
+			if env.Type != "rooms" {
+				select {
+				case bt.ctrl <- env:
+				default:
+				}
+			}
+		}
+		if !isState || !bt.count.Load() {
+			continue
+		}
+		now := time.Now()
+		if !last.IsZero() {
+			gaps = append(gaps, now.Sub(last))
+		}
+		last = now
+		b.stats.states.Add(1)
+		b.stats.stateBytes.Add(int64(len(data)))
+	}
+}
+
+// ackState tells the server a snapshot (game_state or game_delta) arrived,
+// so it can send the following ones as deltas against it.
+func ackState(c *ws.Conn, typ int, data []byte) error {
+	var tick uint64
+	if typ == ws.BinaryMessage {
+		// both binary kinds start with the tick
+		if len(data) < 6 {
+			return fmt.Errorf("short binary message")
+		}
+		tick = uint64(binary.LittleEndian.Uint32(data[2:]))
+	} else {
+		var env struct {
+			Payload struct {
+				Tick uint64 `json:"tick"`
+			} `json:"payload"`
+		}
+		if err := json.Unmarshal(data, &env); err != nil {
+			return err
+		}
+		tick = env.Payload.Tick
+	}
+	return send(c, "state_ack", game.StateAckReq{Tick: tick})
+}
+
+// expect waits for the next control message of one of the given types.
+// An unexpected error message fails the wait.
+func (bt *bot) expect(ctx context.Context, types ...string) (game.Envelope, error) {
+	for {
+		select {
+		case env := <-bt.ctrl:
+			if slices.Contains(types, env.Type) {
+				return env, nil
+			}
+			if env.Type == "error" {
+				return env, fmt.Errorf("waiting for %v: server error %s", types, env.Payload)
+			}
+		case err := <-bt.errc:
+			return game.Envelope{}, err
+		case <-ctx.Done():
+			return game.Envelope{}, ctx.Err()
+		}
+	}
+}
+
+func (b *roomBots) sendInputs(ctx context.Context, c *ws.Conn) error {
+	binary := slices.Contains(b.caps, game.CapBinaryV1)
+	t := time.NewTicker(b.input)
+	defer t.Stop()
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		in := game.InputReq{
+			Seq:     uint32(n + 1),
+			Forward: rng.Intn(3) > 0,
+			Left:    rng.Intn(4) == 0,
+			Turn:    rng.Float64()*0.2 - 0.1,
+			Shoot:   n%4 == 0,
+		}
+		var err error
+		if binary {
+			err = c.WriteBinary(game.EncodeInputBinary(in))
+		} else {
+			err = send(c, "input", in)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		b.stats.inputs.Add(1)
+	}
+}
+
+func send(c *ws.Conn, typ string, payload any) error {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(game.Envelope{Type: typ, Payload: p})
+	if err != nil {
+		return err
+	}
+	return c.WriteText(msg)
+}
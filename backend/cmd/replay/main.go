@@ -0,0 +1,395 @@
+// Command replay plays back the match recordings a server saves with
+// -record-dir.
+//
+//	go run ./cmd/replay -dir recordings rec_xxx
+//
+// re-simulates a recording and prints the result, checking it against the
+// recorded winner.
+//
+//	go run ./cmd/replay -dir recordings -addr :8081
+//
+// streams recordings to WebSocket clients at /replay?id=rec_xxx. A stream
+// speaks enough of the game protocol for the frontend to show it as a
+// spectator: hello, room_state, game_start, game_state every tick and
+// game_over at the end. Clients steer it with replay_control (speed,
+// pause, seek) and get replay_info back.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fps-backend/internal/game"
+	"fps-backend/internal/ws"
+)
+
+const (
+	minSpeed = 0.25
+	maxSpeed = 8
+)
+
+func main() {
+	dir := flag.String("dir", "recordings", "directory the server saves recordings to (its -record-dir)")
+	addr := flag.String("addr", "", "stream recordings to WebSocket clients on this address, e.g. :8081 (empty: print the recording given as argument)")
+	origins := flag.String("allowed-origins", "", "comma separated Origin patterns allowed to connect (empty: any)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: replay [-dir dir] <recording id or file>\n       replay [-dir dir] -addr :8081\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *addr != "" {
+		serve(*addr, *dir, splitList(*origins))
+		return
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	rec, err := open(*dir, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !summarize(rec) {
+		os.Exit(1)
+	}
+}
+
+// open reads a recording by id from dir, or from a file path.
+func open(dir, arg string) (*game.Recording, error) {
+	if game.ValidRecordingID(arg) {
+		return game.OpenRecording(dir, arg)
+	}
+	f, err := os.Open(arg)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return game.ReadRecording(f)
+}
+
+// summarize re-simulates rec and prints the result. It reports whether the
+// winner matches the recorded one.
+func summarize(rec *game.Recording) bool {
+	p := game.NewReplay(rec)
+	winner := ""
+	for {
+		ev, ok := p.Step()
+		if !ok {
+			break
+		}
+		for _, hit := range ev.Hits {
+			if hit.Kill && winner == "" && p.Score(hit.ShooterID) >= rec.Game.WinScore {
+				winner = hit.ShooterID
+			}
+		}
+	}
+	ranks := p.Rankings()
+	if rec.Reason != "" && len(ranks) > 0 {
+		// ended early: the leader wins
+		winner = ranks[0].ID
+	}
+
+	tick := time.Duration(rec.Game.TickMS) * time.Millisecond
+	fmt.Printf("%s  room %q (%s), played %s\n", rec.ID, rec.RoomName, rec.RoomID,
+		time.UnixMilli(rec.StartedAt).Format("2006-01-02 15:04:05"))
+	fmt.Printf("%d ticks (%v), seed %d, first to %d kills\n", rec.Ticks(), time.Duration(rec.Ticks())*tick, rec.Seed, rec.Game.WinScore)
+	if rec.Reason != "" {
+		fmt.Printf("ended early: %s\n", rec.Reason)
+	}
+	for i, r := range ranks {
+		fmt.Printf("%3d. %-16s %-20s kills %d\n", i+1, r.Name, r.ID, r.Score)
+	}
+	names := rec.Names()
+	fmt.Printf("winner: %s (%s)\n", names[rec.WinnerID], rec.WinnerID)
+	if winner != rec.WinnerID {
+		fmt.Printf("replay diverged: re-simulated winner is %s (%s)\n", names[winner], winner)
+		return false
+	}
+	return true
+}
+
+func serve(addr, dir string, origins []string) {
+	s := &server{
+		dir: dir,
+		upgrader: ws.Upgrader{
+			AllowedOrigins: origins,
+			Subprotocols:   []string{game.Subprotocol},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("/replay", s)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Printf("replay listening on %s (recordings in %s)", addr, dir)
+	log.Fatal(srv.ListenAndServe())
+}
+
+type server struct {
+	dir      string
+	upgrader ws.Upgrader
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	rec, err := game.OpenRecording(s.dir, id)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && game.ValidRecordingID(id) {
+			log.Printf("replay %s: %v", id, err)
+		}
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	conn.SetIdleTimeout(30 * time.Second)
+	conn.SetWriteTimeout(10 * time.Second)
+
+	speed := 1.0
+	if v, err := strconv.ParseFloat(r.URL.Query().Get("speed"), 64); err == nil {
+		speed = clampSpeed(v)
+	}
+	st := &stream{
+		conn:     conn,
+		replay:   game.NewReplay(rec),
+		speed:    speed,
+		controls: make(chan game.ReplayControlReq, 16),
+		hello:    make(chan helloMsg, 1),
+		done:     make(chan struct{}),
+	}
+	go st.readLoop()
+	st.run()
+	_ = conn.CloseWithStatus(ws.CloseNormalClosure, "", 2*time.Second)
+}
+
+// stream plays one recording to one client.
+type stream struct {
+	conn   *ws.Conn
+	replay *game.Replay
+	speed  float64
+	paused bool
+
+	controls chan game.ReplayControlReq
+	hello    chan helloMsg
+	// done is closed when the client is gone
+	done chan struct{}
+}
+
+type helloMsg struct {
+	id  string
+	req game.HelloReq
+}
+
+// viewerID is the user id every replay client gets; it is the only
+// spectator of its stream.
+const viewerID = "viewer"
+
+func (st *stream) readLoop() {
+	defer close(st.done)
+	for {
+		b, err := st.conn.ReadText()
+		if err != nil {
+			return
+		}
+		var env game.Envelope
+		if json.Unmarshal(b, &env) != nil {
+			continue
+		}
+		switch env.Type {
+		case "hello":
+			var req game.HelloReq
+			_ = json.Unmarshal(env.Payload, &req)
+			select {
+			case st.hello <- helloMsg{id: env.ID, req: req}:
+			default:
+			}
+		case "ping":
+			var req game.PingReq
+			_ = json.Unmarshal(env.Payload, &req)
+			st.send("", "pong", game.PongMsg{T: req.T})
+		case "replay_control":
+			var req game.ReplayControlReq
+			if json.Unmarshal(env.Payload, &req) != nil {
+				continue
+			}
+			select {
+			case st.controls <- req:
+			case <-st.done:
+				return
+			}
+		}
+		// anything else (input, state_ack, room_leave…) means nothing here
+	}
+}
+
+func (st *stream) run() {
+	var hello helloMsg
+	select {
+	case hello = <-st.hello:
+	case <-st.done:
+		return
+	case <-time.After(10 * time.Second):
+		return
+	}
+	rec := st.replay.Recording()
+	name := strings.TrimSpace(hello.req.Name)
+	if name == "" {
+		name = "viewer"
+	}
+	st.send(hello.id, "hello_ack", game.HelloAck{
+		UserID:   viewerID,
+		Name:     name,
+		Version:  game.ProtocolVersion,
+		Caps:     []string{},
+		Encoding: game.EncodingJSON,
+	})
+	st.send("", "room_state", roomState(rec, name))
+	st.restart()
+
+	ticker := time.NewTicker(st.interval())
+	defer ticker.Stop()
+	for {
+		var tick <-chan time.Time
+		if !st.paused && !st.replay.Done() {
+			tick = ticker.C
+		}
+		select {
+		case <-st.done:
+			return
+		case req := <-st.controls:
+			if req.Speed != nil {
+				st.speed = clampSpeed(*req.Speed)
+				ticker.Reset(st.interval())
+			}
+			if req.Paused != nil {
+				st.paused = *req.Paused
+			}
+			if req.Seek != nil {
+				st.replay.Seek(*req.Seek)
+				st.restart()
+			} else {
+				st.sendInfo()
+			}
+		case <-tick:
+			if _, ok := st.replay.Step(); ok {
+				st.send("", "game_state", st.replay.GameState())
+			}
+			if st.replay.Done() {
+				st.sendOver()
+			}
+		}
+	}
+}
+
+// restart shows the current tick as if the match started there.
+func (st *stream) restart() {
+	rec := st.replay.Recording()
+	st.send("", "game_start", rec.Game)
+	st.sendInfo()
+	st.send("", "game_state", st.replay.GameState())
+	if st.replay.Done() {
+		st.sendOver()
+	}
+}
+
+func (st *stream) sendInfo() {
+	rec := st.replay.Recording()
+	st.send("", "replay_info", game.ReplayInfoMsg{
+		RecordingID: rec.ID,
+		RoomName:    rec.RoomName,
+		StartedAt:   rec.StartedAt,
+		Ticks:       rec.Ticks(),
+		Tick:        st.replay.Tick(),
+		Speed:       st.speed,
+		Paused:      st.paused,
+	})
+}
+
+func (st *stream) sendOver() {
+	rec := st.replay.Recording()
+	st.send("", "game_over", game.GameOverMsg{
+		RoomID:      rec.RoomID,
+		RoomName:    rec.RoomName,
+		WinnerID:    rec.WinnerID,
+		WinScore:    rec.Game.WinScore,
+		Rankings:    st.replay.Rankings(),
+		Reason:      rec.Reason,
+		RecordingID: rec.ID,
+	})
+}
+
+func (st *stream) interval() time.Duration {
+	tick := time.Duration(st.replay.Recording().Game.TickMS) * time.Millisecond
+	if tick <= 0 {
+		tick = 50 * time.Millisecond
+	}
+	return time.Duration(float64(tick) / st.speed)
+}
+
+func (st *stream) send(id, typ string, payload any) {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	b, _ := json.Marshal(game.Envelope{Type: typ, ID: id, Payload: p})
+	// a failed write also ends the read loop, which stops the stream
+	_ = st.conn.WriteText(b)
+}
+
+// roomState is the room_state of a replay: a started room with everyone
+// who played, watched by the viewer.
+func roomState(rec *game.Recording, viewer string) game.RoomState {
+	out := game.RoomState{
+		ID:               rec.RoomID,
+		Name:             rec.RoomName,
+		Started:          true,
+		WinScore:         rec.Game.WinScore,
+		ShowEnemiesOnMap: rec.Game.ShowEnemiesOnMap,
+		WallText:         rec.Game.WallText,
+		Players:          []game.PlayerState{},
+		Spectators:       []game.PlayerState{{ID: viewerID, Name: viewer}},
+	}
+	for id, name := range rec.Names() {
+		out.Players = append(out.Players, game.PlayerState{ID: id, Name: name})
+	}
+	sort.Slice(out.Players, func(i, j int) bool { return out.Players[i].ID < out.Players[j].ID })
+	out.MaxPlayers = len(out.Players)
+	return out
+}
+
+func clampSpeed(v float64) float64 {
+	if math.IsNaN(v) || v <= 0 {
+		return 1
+	}
+	return min(max(v, minSpeed), maxSpeed)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -1,23 +1,91 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"fps-backend/internal/game"
+	"fps-backend/internal/ws"
 )
 
 func main() {
 	addr := flag.String("addr", ":8080", "http listen address")
 	tickRate := flag.Int("tick", 20, "game tick rate (Hz)")
+	compress := flag.Bool("compress", true, "negotiate permessage-deflate with clients")
+	compressLevel := flag.Int("compress-level", 1, "deflate level (1-9)")
+	noContextTakeover := flag.Bool("compress-no-context-takeover", false, "reset the compressor after every message and share compressors between connections (less memory, worse ratio)")
+	origins := flag.String("allowed-origins", "", "comma separated Origin patterns allowed to connect, e.g. https://fps.example.com,http://localhost:* (empty: any)")
+	subprotocols := flag.String("subprotocols", game.Subprotocol, "comma separated Sec-WebSocket-Protocol values, preferred first")
+	pingInterval := flag.Duration("ping-interval", 10*time.Second, "how often to ping clients")
+	pongTimeout := flag.Duration("pong-timeout", 10*time.Second, "drop clients whose pong is this late")
+	idleTimeout := flag.Duration("idle-timeout", 30*time.Second, "drop connections silent for this long")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "per-frame write deadline")
+	resumeGrace := flag.Duration("resume-grace", 30*time.Second, "how long a dropped player's match slot is kept for resume")
+	returnToLobby := flag.Duration("return-to-lobby", 15*time.Second, "how long a finished room shows the results before going back to the lobby")
+	roomIdle := flag.Duration("room-idle-timeout", 10*time.Minute, "close lobby rooms nothing has happened in for this long")
+	afkTimeout := flag.Duration("afk-timeout", 30*time.Second, "mark players in a match AFK after this long without input")
+	afkKick := flag.Duration("afk-kick-timeout", 60*time.Second, "remove players that stay AFK for this much longer")
+	maxRewind := flag.Duration("max-rewind", 200*time.Millisecond, "how far back shots are tested against what the shooter saw (negative: no lag compensation)")
+	logHits := flag.Bool("log-hits", false, "log every hit with how far it was rewound")
+	recordDir := flag.String("record-dir", "", "save every finished match here for cmd/replay (empty: no recording)")
+	sendQueue := flag.Int("send-queue", 64, "outbound messages a client may have queued before it counts as backed up")
+	slowTimeout := flag.Duration("slow-consumer-timeout", 5*time.Second, "drop clients backed up for this long")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 16, "concurrent connections allowed from one remote address (negative: no cap)")
+	rateLimits := flag.String("rate-limits", "", "comma separated per-client limits overriding the defaults, as type=rate/s:burst, e.g. chat_send=0.5:3,*=20:40")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 60*time.Second, "on SIGINT/SIGTERM, how long running matches may continue before being ended")
 	flag.Parse()
 
-	hub := game.NewHub(time.Second / time.Duration(*tickRate))
+	if *compressLevel < 1 || *compressLevel > 9 {
+		log.Fatalf("-compress-level: %d is not a deflate level (1-9)", *compressLevel)
+	}
+	limits, err := parseRateLimits(*rateLimits)
+	if err != nil {
+		log.Fatalf("-rate-limits: %v", err)
+	}
+
+	hub := game.NewHub(game.Config{
+		Tick:                time.Second / time.Duration(*tickRate),
+		AllowedOrigins:      splitList(*origins),
+		Subprotocols:        splitList(*subprotocols),
+		PingInterval:        *pingInterval,
+		PongTimeout:         *pongTimeout,
+		IdleTimeout:         *idleTimeout,
+		WriteTimeout:        *writeTimeout,
+		ResumeGrace:         *resumeGrace,
+		ReturnToLobby:       *returnToLobby,
+		RoomIdleTimeout:     *roomIdle,
+		AFKTimeout:          *afkTimeout,
+		AFKKickTimeout:      *afkKick,
+		MaxRewind:           *maxRewind,
+		LogHits:             *logHits,
+		RecordDir:           *recordDir,
+		SendQueue:           *sendQueue,
+		SlowConsumerTimeout: *slowTimeout,
+		RateLimits:          limits,
+		MaxConnsPerIP:       *maxConnsPerIP,
+		Compression: ws.CompressionOptions{
+			Enabled:                 *compress,
+			Level:                   *compressLevel,
+			ServerNoContextTakeover: *noContextTakeover,
+		},
+	})
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if hub.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
@@ -29,7 +97,67 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	log.Printf("backend listening on %s", *addr)
-	log.Fatal(srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("backend listening on %s", *addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down, matches have %s to finish (signal again to force)", *shutdownTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	go func() {
+		// a second signal cuts the grace period short
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		cancel()
+	}()
+	hub.Shutdown(drainCtx)
+
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelHTTP()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	log.Printf("bye")
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
 }
 
+// parseRateLimits parses type=rate:burst pairs.
+func parseRateLimits(s string) (map[string]game.RateLimit, error) {
+	limits := map[string]game.RateLimit{}
+	for _, v := range splitList(s) {
+		typ, spec, ok := strings.Cut(v, "=")
+		rate, burst, ok2 := strings.Cut(spec, ":")
+		if !ok || !ok2 || typ == "" {
+			return nil, fmt.Errorf("%q is not type=rate:burst", v)
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r < 0 {
+			return nil, fmt.Errorf("%q: bad rate", v)
+		}
+		b, err := strconv.Atoi(burst)
+		if err != nil || b < 0 {
+			return nil, fmt.Errorf("%q: bad burst", v)
+		}
+		limits[typ] = game.RateLimit{Rate: r, Burst: b}
+	}
+	return limits, nil
+}
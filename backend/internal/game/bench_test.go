@@ -0,0 +1,97 @@
+package game
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkRoomsTick runs one tick of many running matches at once, the
+// way the room loops do on a server: every room steps on its own goroutine,
+// then sends game_state to its members. One op is a tick of all rooms.
+//
+//	go test ./internal/game -run '^$' -bench RoomsTick
+//
+// Clients have no connection; their queues only keep the newest snapshot,
+// so this measures simulation and encoding, not the network. For that see
+// cmd/loadtest.
+func BenchmarkRoomsTick(b *testing.B) {
+	for _, rooms := range []int{100, 500} {
+		for _, enc := range []string{"json", "binary", "delta"} {
+			rooms, enc := rooms, enc
+			b.Run(fmt.Sprintf("rooms=%d/%s", rooms, enc), func(b *testing.B) {
+				benchmarkRoomsTick(b, rooms, 4, enc)
+			})
+		}
+	}
+}
+
+func benchmarkRoomsTick(b *testing.B, rooms, players int, enc string) {
+	h := NewHub(Config{})
+	// the benchmark drives the ticks; the room tickers never fire
+	h.tick = time.Hour
+	all := make([]*Room, rooms)
+	for i := range all {
+		r := NewRoom(fmt.Sprintf("r_%d", i), "bench", "")
+		h.startRoom(r)
+		all[i] = r
+		err := r.call(func() {
+			for j := 0; j < players; j++ {
+				c := &Client{
+					id:      fmt.Sprintf("u_%d_%d", i, j),
+					roomID:  r.id,
+					binary:  enc != "json",
+					delta:   enc == "delta",
+					queue:   newSendQueue(),
+					closing: make(chan struct{}),
+				}
+				r.AddPlayer(c.id, c.id)
+				r.members[c.id] = c
+			}
+			// nobody wins during the benchmark
+			winScore := 1 << 30
+			r.ConfigureForStart(&winScore, nil, nil)
+			h.beginMatch()
+			r.StartSeeded(int64(i))
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Cleanup(func() {
+		for _, r := range all {
+			r := r
+			_ = r.call(r.close)
+		}
+	})
+
+	var wg sync.WaitGroup
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		wg.Add(rooms)
+		for _, r := range all {
+			r := r
+			seq := uint32(n + 1)
+			err := r.do(func() {
+				defer wg.Done()
+				for id := range r.players {
+					r.SetInput(id, InputReq{Seq: seq, Forward: true, Turn: 0.05, Shoot: seq%4 == 0, ViewTick: r.now()})
+				}
+				r.step()
+				if enc == "delta" {
+					for _, c := range r.members {
+						r.ackState(c, r.now())
+					}
+				}
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*rooms), "ns/room")
+}
@@ -0,0 +1,371 @@
+package game
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Compact binary encoding for the hot-path messages (input and game_state).
+// Everything else stays JSON. Clients opt in with the CapBinaryV1
+// capability in hello; see protocol.go for the version 1 hello, which asked
+// for it in an encodings list.
+//
+// Every message starts with a 2 byte header: format version, message kind.
+// Multi-byte integers are little endian.
+//
+//	input      : flags u8 | turn i16 | seq u32 | viewTick u32
+//	game_state : tick u32 | count u16 | count × (idLen u8 | id | x u16 | y u16 | dir i16 | hp u8 | score u16) | count × ack u32
+//	game_delta : tick u32 | base u32 | count u16 | count × (idLen u8 | id | mask u8 | fields) | removed u16 | removed × (idLen u8 | id)
+//
+// A game_delta player carries only the fields whose mask bit is set, in
+// the order x, y, dir, hp, score, ack (ack as u32), encoded as in
+// game_state.
+//
+// seq, viewTick and the acks were appended later; decoders accept messages
+// without them (as 0) and ignore trailing bytes they do not know.
+//
+// Positions are quantized to 1/256 of a map cell and angles to 1/10000 rad.
+// Player names are not included; clients take them from room_state.
+const (
+	EncodingJSON     = "json"
+	EncodingBinaryV1 = "bin.v1"
+)
+
+const (
+	binaryVersion1 byte = 1
+
+	binKindInput     byte = 1
+	binKindGameState byte = 2
+	binKindGameDelta byte = 3
+)
+
+const (
+	deltaX byte = 1 << iota
+	deltaY
+	deltaDir
+	deltaHP
+	deltaScore
+	deltaAck
+)
+
+// deltaFieldSizes are the encoded sizes of the game_delta fields, by mask
+// bit.
+var deltaFieldSizes = [...]int{2, 2, 2, 1, 2, 4}
+
+const (
+	inputForward byte = 1 << iota
+	inputBack
+	inputLeft
+	inputRight
+	inputShoot
+)
+
+const (
+	posScale   = 256
+	angleScale = 10000
+)
+
+var errBadBinary = errors.New("malformed binary message")
+
+func EncodeInputBinary(in InputReq) []byte {
+	b := make([]byte, 13)
+	b[0], b[1], b[2] = binaryVersion1, binKindInput, inputFlags(in)
+	binary.LittleEndian.PutUint16(b[3:], uint16(quantizeAngle(in.Turn)))
+	binary.LittleEndian.PutUint32(b[5:], in.Seq)
+	binary.LittleEndian.PutUint32(b[9:], uint32(in.ViewTick))
+	return b
+}
+
+func inputFlags(in InputReq) byte {
+	var flags byte
+	if in.Forward {
+		flags |= inputForward
+	}
+	if in.Back {
+		flags |= inputBack
+	}
+	if in.Left {
+		flags |= inputLeft
+	}
+	if in.Right {
+		flags |= inputRight
+	}
+	if in.Shoot {
+		flags |= inputShoot
+	}
+	return flags
+}
+
+// inputFromFlags is the InputReq of the keys in flags.
+func inputFromFlags(flags byte) InputReq {
+	return InputReq{
+		Forward: flags&inputForward != 0,
+		Back:    flags&inputBack != 0,
+		Left:    flags&inputLeft != 0,
+		Right:   flags&inputRight != 0,
+		Shoot:   flags&inputShoot != 0,
+	}
+}
+
+func DecodeInputBinary(b []byte) (InputReq, error) {
+	if len(b) < 5 || b[0] != binaryVersion1 || b[1] != binKindInput {
+		return InputReq{}, errBadBinary
+	}
+	in := inputFromFlags(b[2])
+	in.Turn = float64(int16(binary.LittleEndian.Uint16(b[3:]))) / angleScale
+	if len(b) >= 9 {
+		in.Seq = binary.LittleEndian.Uint32(b[5:])
+	}
+	if len(b) >= 13 {
+		in.ViewTick = uint64(binary.LittleEndian.Uint32(b[9:]))
+	}
+	return in, nil
+}
+
+func EncodeGameStateBinary(gs GameState) []byte {
+	n := len(gs.Players)
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+	b := make([]byte, 8, 8+n*32)
+	b[0] = binaryVersion1
+	b[1] = binKindGameState
+	binary.LittleEndian.PutUint32(b[2:], uint32(gs.Tick))
+	binary.LittleEndian.PutUint16(b[6:], uint16(n))
+	for _, p := range gs.Players[:n] {
+		b = appendID(b, p.ID)
+		b = binary.LittleEndian.AppendUint16(b, quantizePos(p.X))
+		b = binary.LittleEndian.AppendUint16(b, quantizePos(p.Y))
+		b = binary.LittleEndian.AppendUint16(b, uint16(quantizeAngle(p.Dir)))
+		b = append(b, byte(clampInt(p.HP, 0, math.MaxUint8)))
+		b = binary.LittleEndian.AppendUint16(b, uint16(clampInt(p.Score, 0, math.MaxUint16)))
+	}
+	for _, p := range gs.Players[:n] {
+		b = binary.LittleEndian.AppendUint32(b, p.Ack)
+	}
+	return b
+}
+
+func DecodeGameStateBinary(b []byte) (GameState, error) {
+	if len(b) < 8 || b[0] != binaryVersion1 || b[1] != binKindGameState {
+		return GameState{}, errBadBinary
+	}
+	gs := GameState{Tick: uint64(binary.LittleEndian.Uint32(b[2:]))}
+	n := int(binary.LittleEndian.Uint16(b[6:]))
+	gs.Players = make([]PlayerFrame, 0, n)
+	b = b[8:]
+	for i := 0; i < n; i++ {
+		if len(b) < 1 {
+			return GameState{}, errBadBinary
+		}
+		idLen := int(b[0])
+		if len(b) < 1+idLen+9 {
+			return GameState{}, errBadBinary
+		}
+		id := string(b[1 : 1+idLen])
+		b = b[1+idLen:]
+		gs.Players = append(gs.Players, PlayerFrame{
+			ID:    id,
+			X:     float64(binary.LittleEndian.Uint16(b[0:])) / posScale,
+			Y:     float64(binary.LittleEndian.Uint16(b[2:])) / posScale,
+			Dir:   float64(int16(binary.LittleEndian.Uint16(b[4:]))) / angleScale,
+			HP:    int(b[6]),
+			Score: int(binary.LittleEndian.Uint16(b[7:])),
+		})
+		b = b[9:]
+	}
+	if len(b) >= 4*n {
+		for i := range gs.Players {
+			gs.Players[i].Ack = binary.LittleEndian.Uint32(b[4*i:])
+		}
+	}
+	return gs, nil
+}
+
+func EncodeGameDeltaBinary(d GameDelta) []byte {
+	n := min(len(d.Players), math.MaxUint16)
+	b := make([]byte, 12, 14+n*24)
+	b[0] = binaryVersion1
+	b[1] = binKindGameDelta
+	binary.LittleEndian.PutUint32(b[2:], uint32(d.Tick))
+	binary.LittleEndian.PutUint32(b[6:], uint32(d.Base))
+	binary.LittleEndian.PutUint16(b[10:], uint16(n))
+	for _, p := range d.Players[:n] {
+		b = appendID(b, p.ID)
+		var mask byte
+		if p.X != nil {
+			mask |= deltaX
+		}
+		if p.Y != nil {
+			mask |= deltaY
+		}
+		if p.Dir != nil {
+			mask |= deltaDir
+		}
+		if p.HP != nil {
+			mask |= deltaHP
+		}
+		if p.Score != nil {
+			mask |= deltaScore
+		}
+		if p.Ack != nil {
+			mask |= deltaAck
+		}
+		b = append(b, mask)
+		if p.X != nil {
+			b = binary.LittleEndian.AppendUint16(b, quantizePos(*p.X))
+		}
+		if p.Y != nil {
+			b = binary.LittleEndian.AppendUint16(b, quantizePos(*p.Y))
+		}
+		if p.Dir != nil {
+			b = binary.LittleEndian.AppendUint16(b, uint16(quantizeAngle(*p.Dir)))
+		}
+		if p.HP != nil {
+			b = append(b, byte(clampInt(*p.HP, 0, math.MaxUint8)))
+		}
+		if p.Score != nil {
+			b = binary.LittleEndian.AppendUint16(b, uint16(clampInt(*p.Score, 0, math.MaxUint16)))
+		}
+		if p.Ack != nil {
+			b = binary.LittleEndian.AppendUint32(b, *p.Ack)
+		}
+	}
+	r := min(len(d.Removed), math.MaxUint16)
+	b = binary.LittleEndian.AppendUint16(b, uint16(r))
+	for _, id := range d.Removed[:r] {
+		b = appendID(b, id)
+	}
+	return b
+}
+
+func DecodeGameDeltaBinary(b []byte) (GameDelta, error) {
+	if len(b) < 12 || b[0] != binaryVersion1 || b[1] != binKindGameDelta {
+		return GameDelta{}, errBadBinary
+	}
+	d := GameDelta{
+		Tick: uint64(binary.LittleEndian.Uint32(b[2:])),
+		Base: uint64(binary.LittleEndian.Uint32(b[6:])),
+	}
+	n := int(binary.LittleEndian.Uint16(b[10:]))
+	b = b[12:]
+	var ok bool
+	for i := 0; i < n; i++ {
+		p := PlayerDelta{}
+		if p.ID, b, ok = readID(b); !ok || len(b) < 1 {
+			return GameDelta{}, errBadBinary
+		}
+		mask := b[0]
+		b = b[1:]
+		size := 0
+		for i, n := range deltaFieldSizes {
+			if mask&(1<<i) != 0 {
+				size += n
+			}
+		}
+		if len(b) < size {
+			return GameDelta{}, errBadBinary
+		}
+		if mask&deltaX != 0 {
+			v := float64(binary.LittleEndian.Uint16(b)) / posScale
+			p.X, b = &v, b[2:]
+		}
+		if mask&deltaY != 0 {
+			v := float64(binary.LittleEndian.Uint16(b)) / posScale
+			p.Y, b = &v, b[2:]
+		}
+		if mask&deltaDir != 0 {
+			v := float64(int16(binary.LittleEndian.Uint16(b))) / angleScale
+			p.Dir, b = &v, b[2:]
+		}
+		if mask&deltaHP != 0 {
+			v := int(b[0])
+			p.HP, b = &v, b[1:]
+		}
+		if mask&deltaScore != 0 {
+			v := int(binary.LittleEndian.Uint16(b))
+			p.Score, b = &v, b[2:]
+		}
+		if mask&deltaAck != 0 {
+			v := binary.LittleEndian.Uint32(b)
+			p.Ack, b = &v, b[4:]
+		}
+		d.Players = append(d.Players, p)
+	}
+	if len(b) < 2 {
+		return GameDelta{}, errBadBinary
+	}
+	r := int(binary.LittleEndian.Uint16(b))
+	b = b[2:]
+	for i := 0; i < r; i++ {
+		var id string
+		if id, b, ok = readID(b); !ok {
+			return GameDelta{}, errBadBinary
+		}
+		d.Removed = append(d.Removed, id)
+	}
+	return d, nil
+}
+
+// quantizeState rounds gs to what a binary client decodes.
+func quantizeState(gs GameState) GameState {
+	out := GameState{Tick: gs.Tick, Players: make([]PlayerFrame, len(gs.Players))}
+	for i, p := range gs.Players {
+		p.X = float64(quantizePos(p.X)) / posScale
+		p.Y = float64(quantizePos(p.Y)) / posScale
+		p.Dir = float64(quantizeAngle(p.Dir)) / angleScale
+		p.HP = clampInt(p.HP, 0, math.MaxUint8)
+		p.Score = clampInt(p.Score, 0, math.MaxUint16)
+		out.Players[i] = p
+	}
+	return out
+}
+
+func appendID(b []byte, id string) []byte {
+	if len(id) > math.MaxUint8 {
+		id = id[:math.MaxUint8]
+	}
+	b = append(b, byte(len(id)))
+	return append(b, id...)
+}
+
+func readID(b []byte) (string, []byte, bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", b, false
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], true
+}
+
+func quantizePos(v float64) uint16 {
+	q := math.Round(v * posScale)
+	if q < 0 {
+		return 0
+	}
+	if q > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(q)
+}
+
+func quantizeAngle(a float64) int16 {
+	q := math.Round(a * angleScale)
+	if q < math.MinInt16 {
+		return math.MinInt16
+	}
+	if q > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	return int16(q)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
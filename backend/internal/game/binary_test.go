@@ -0,0 +1,110 @@
+package game
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestInputBinaryRoundTrip(t *testing.T) {
+	tests := []InputReq{
+		{},
+		{Forward: true, Back: true, Left: true, Right: true, Shoot: true},
+		{Forward: true, Turn: 0.0123, Seq: 1},
+		{Left: true, Turn: -0.5, Seq: 42, ViewTick: 1234},
+		{Shoot: true, Turn: math.Pi, Seq: math.MaxUint32, ViewTick: math.MaxUint32},
+		{Back: true, Turn: -math.Pi},
+	}
+	for _, in := range tests {
+		got, err := DecodeInputBinary(EncodeInputBinary(in))
+		if err != nil {
+			t.Fatalf("%+v: %v", in, err)
+		}
+		want := in
+		want.Turn = float64(quantizeAngle(in.Turn)) / angleScale
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+		if math.Abs(got.Turn-in.Turn) > 0.5/angleScale {
+			t.Errorf("turn %v decoded as %v", in.Turn, got.Turn)
+		}
+	}
+}
+
+func TestDecodeInputBinary(t *testing.T) {
+	full := EncodeInputBinary(InputReq{Forward: true, Turn: 0.25, Seq: 7, ViewTick: 9})
+	tests := []struct {
+		name string
+		b    []byte
+		want InputReq
+		ok   bool
+	}{
+		{name: "full", b: full, want: InputReq{Forward: true, Turn: 0.25, Seq: 7, ViewTick: 9}, ok: true},
+		{name: "trailing bytes", b: append(append([]byte(nil), full...), 1, 2, 3), want: InputReq{Forward: true, Turn: 0.25, Seq: 7, ViewTick: 9}, ok: true},
+		{name: "without viewTick", b: full[:9], want: InputReq{Forward: true, Turn: 0.25, Seq: 7}, ok: true},
+		{name: "without seq", b: full[:5], want: InputReq{Forward: true, Turn: 0.25}, ok: true},
+		{name: "truncated", b: full[:4]},
+		{name: "header only", b: full[:2]},
+		{name: "empty"},
+		{name: "wrong version", b: append([]byte{2}, full[1:]...)},
+		{name: "wrong kind", b: append([]byte{binaryVersion1, binKindGameState}, full[2:]...)},
+	}
+	for _, tt := range tests {
+		got, err := DecodeInputBinary(tt.b)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// testStates are game states covering the edges of the binary encoding.
+var testStates = []GameState{
+	{Tick: 1, Players: []PlayerFrame{}},
+	{Tick: 2, Players: []PlayerFrame{
+		{ID: "u_a", Name: "alice", X: 2.5, Y: 8.5, Dir: 1.25, HP: 100, Score: 3, Ack: 17},
+		{ID: "u_b", Name: "bob", X: 13.1234, Y: 2.0001, Dir: -math.Pi, HP: 1},
+	}},
+	{Tick: math.MaxUint32, Players: []PlayerFrame{
+		// out of range values are clamped
+		{ID: "u_c", X: -1, Y: 1000, Dir: math.Pi, HP: 300, Score: -2, Ack: math.MaxUint32},
+		{ID: "", HP: 0, Score: math.MaxUint16 + 5},
+	}},
+}
+
+// decoded is what a binary client sees of gs: quantized and without names.
+func decoded(gs GameState) GameState {
+	out := quantizeState(gs)
+	for i := range out.Players {
+		out.Players[i].Name = ""
+	}
+	return out
+}
+
+func TestGameStateBinaryRoundTrip(t *testing.T) {
+	for _, gs := range testStates {
+		b := EncodeGameStateBinary(gs)
+		got, err := DecodeGameStateBinary(b)
+		if err != nil {
+			t.Fatalf("tick %d: %v", gs.Tick, err)
+		}
+		if want := decoded(gs); !reflect.DeepEqual(got, want) {
+			t.Errorf("tick %d:\n got %+v\nwant %+v", gs.Tick, got, want)
+		}
+		// quantizing is idempotent, so a decoded state encodes the same
+		if again := EncodeGameStateBinary(got); !reflect.DeepEqual(again, b) {
+			t.Errorf("tick %d: re-encoding changed the bytes", gs.Tick)
+		}
+
+		for n := 0; n < len(b); n++ {
+			// truncated messages fail or, if only the acks are cut, decode
+			// without them; they never panic
+			if got, err := DecodeGameStateBinary(b[:n]); err == nil && len(got.Players) != len(gs.Players) {
+				t.Errorf("tick %d: %d of %d bytes decoded %d players", gs.Tick, n, len(b), len(got.Players))
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package game
+
+import (
+	"time"
+
+	"fps-backend/internal/ws"
+)
+
+// Subprotocol versions the WebSocket protocol. Clients that offer no
+// subprotocol are still accepted and treated as this version.
+const Subprotocol = "fps.v1"
+
+type Config struct {
+	Tick time.Duration
+
+	// AllowedOrigins restricts which pages may open a game socket; see
+	// ws.Upgrader.AllowedOrigins. Empty allows any origin.
+	AllowedOrigins []string
+	Subprotocols   []string
+
+	// PingInterval is how often the server pings each client. A client
+	// whose last pong is older than PingInterval+PongTimeout is dropped.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// IdleTimeout drops a connection that sends no frame at all (including
+	// pongs) for this long.
+	IdleTimeout time.Duration
+	// WriteTimeout bounds a single write to a client socket.
+	WriteTimeout time.Duration
+
+	// ResumeGrace is how long a player who dropped out of a running match
+	// keeps their slot and score, waiting for a resume.
+	ResumeGrace time.Duration
+
+	// ReturnToLobby is how long a finished room shows the results before
+	// it goes back to the lobby for the next round. Players can skip the
+	// wait with room_rematch.
+	ReturnToLobby time.Duration
+
+	// RoomIdleTimeout closes a room that sits in the lobby with nothing
+	// happening in it for this long.
+	RoomIdleTimeout time.Duration
+	// A player in a running match who sends no input for AFKTimeout is
+	// marked AFK in room_state, and removed from the room if it stays
+	// AFK for a further AFKKickTimeout.
+	AFKTimeout     time.Duration
+	AFKKickTimeout time.Duration
+
+	// MaxRewind is how far back a shot may be tested against the
+	// positions its shooter saw (lag compensation). Zero means 200ms,
+	// negative turns lag compensation off. LogHits logs every hit with
+	// how far it was rewound.
+	MaxRewind time.Duration
+	LogHits   bool
+
+	// RecordDir is where finished matches are saved for replay, see
+	// recording.go. Empty turns recording off.
+	RecordDir string
+
+	// SendQueue is how many outbound messages a client may have queued
+	// before it counts as backed up. A client backed up for longer than
+	// SlowConsumerTimeout, or with 8×SendQueue messages queued, is
+	// disconnected rather than having messages dropped.
+	SendQueue           int
+	SlowConsumerTimeout time.Duration
+
+	// RateLimits caps how often a client may send each message type; see
+	// RateLimit. Entries override DefaultRateLimits, a zero RateLimit
+	// lifts the limit. Clients that keep exceeding them are muted and
+	// then disconnected.
+	RateLimits map[string]RateLimit
+	// MaxConnsPerIP caps concurrent connections from one remote address.
+	// Zero means 16, negative means no cap.
+	MaxConnsPerIP int
+
+	// Compression enables permessage-deflate for clients that offer it.
+	Compression ws.CompressionOptions
+}
+
+func (c Config) withDefaults() Config {
+	if c.Tick <= 0 {
+		c.Tick = 50 * time.Millisecond
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = 10 * time.Second
+	}
+	if c.PongTimeout <= 0 {
+		c.PongTimeout = 10 * time.Second
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = 30 * time.Second
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	if c.ResumeGrace <= 0 {
+		c.ResumeGrace = 30 * time.Second
+	}
+	if c.ReturnToLobby <= 0 {
+		c.ReturnToLobby = 15 * time.Second
+	}
+	if c.RoomIdleTimeout <= 0 {
+		c.RoomIdleTimeout = 10 * time.Minute
+	}
+	if c.AFKTimeout <= 0 {
+		c.AFKTimeout = 30 * time.Second
+	}
+	if c.AFKKickTimeout <= 0 {
+		c.AFKKickTimeout = 60 * time.Second
+	}
+	if c.MaxRewind == 0 {
+		c.MaxRewind = 200 * time.Millisecond
+	}
+	if c.SendQueue <= 0 {
+		c.SendQueue = 64
+	}
+	if c.SlowConsumerTimeout <= 0 {
+		c.SlowConsumerTimeout = 5 * time.Second
+	}
+	limits := map[string]RateLimit{
+		// the frontend sends one input per tick
+		"input": {Rate: 2 * float64(time.Second/c.Tick), Burst: int(time.Second / c.Tick)},
+		// delta clients ack up to one snapshot per tick
+		"state_ack": {Rate: 2 * float64(time.Second/c.Tick), Burst: int(time.Second / c.Tick)},
+	}
+	for typ, l := range DefaultRateLimits {
+		limits[typ] = l
+	}
+	for typ, l := range c.RateLimits {
+		limits[typ] = l
+	}
+	c.RateLimits = limits
+	if c.MaxConnsPerIP == 0 {
+		c.MaxConnsPerIP = 16
+	}
+	if len(c.Subprotocols) == 0 {
+		c.Subprotocols = []string{Subprotocol}
+	}
+	return c
+}
@@ -0,0 +1,255 @@
+package game
+
+import "encoding/json"
+
+// Delta snapshots (CapDeltaV1). A client that acks the snapshots it
+// received with state_ack gets game_delta instead of a full game_state:
+// only the fields that changed since its last acked snapshot (the
+// baseline). A full game_state, the keyframe, is sent when the client has
+// no usable baseline and at least every keyframeTicks.
+//
+// Keyframes and deltas carry no player names; clients take them from
+// room_state.
+
+// keyframeTicks is the longest a delta client goes without a keyframe, and
+// how many past snapshots a room keeps as baselines.
+const keyframeTicks = 40
+
+type GameDelta struct {
+	Tick uint64 `json:"tick"`
+	// Base is the acked tick the delta applies to
+	Base uint64 `json:"base"`
+	// Players are the players that changed or joined since Base; of
+	// joined players every field is set
+	Players []PlayerDelta `json:"players,omitempty"`
+	// Removed are the ids of players gone since Base
+	Removed []string `json:"removed,omitempty"`
+}
+
+// PlayerDelta holds the fields of a PlayerFrame that changed; nil means
+// unchanged.
+type PlayerDelta struct {
+	ID    string   `json:"id"`
+	X     *float64 `json:"x,omitempty"`
+	Y     *float64 `json:"y,omitempty"`
+	Dir   *float64 `json:"dir,omitempty"`
+	HP    *int     `json:"hp,omitempty"`
+	Score *int     `json:"score,omitempty"`
+	Ack   *uint32  `json:"ack,omitempty"`
+}
+
+type StateAckReq struct {
+	Tick uint64 `json:"tick"`
+}
+
+// DiffGameState returns the delta that turns base into cur.
+func DiffGameState(base, cur GameState) GameDelta {
+	d := GameDelta{Tick: cur.Tick, Base: base.Tick}
+	old := make(map[string]*PlayerFrame, len(base.Players))
+	for i := range base.Players {
+		old[base.Players[i].ID] = &base.Players[i]
+	}
+	for i := range cur.Players {
+		p := &cur.Players[i]
+		o := old[p.ID]
+		delete(old, p.ID)
+		pd := PlayerDelta{ID: p.ID}
+		changed := o == nil
+		if o == nil || o.X != p.X {
+			pd.X, changed = &p.X, true
+		}
+		if o == nil || o.Y != p.Y {
+			pd.Y, changed = &p.Y, true
+		}
+		if o == nil || o.Dir != p.Dir {
+			pd.Dir, changed = &p.Dir, true
+		}
+		if o == nil || o.HP != p.HP {
+			pd.HP, changed = &p.HP, true
+		}
+		if o == nil || o.Score != p.Score {
+			pd.Score, changed = &p.Score, true
+		}
+		if o == nil || o.Ack != p.Ack {
+			pd.Ack, changed = &p.Ack, true
+		}
+		if changed {
+			d.Players = append(d.Players, pd)
+		}
+	}
+	for _, p := range base.Players {
+		if _, gone := old[p.ID]; gone {
+			d.Removed = append(d.Removed, p.ID)
+		}
+	}
+	return d
+}
+
+// ApplyGameDelta returns the state d describes on top of base, which must
+// be the snapshot of tick d.Base. base is not modified.
+func ApplyGameDelta(base GameState, d GameDelta) GameState {
+	out := GameState{Tick: d.Tick, Players: make([]PlayerFrame, 0, len(base.Players)+len(d.Players))}
+	removed := make(map[string]bool, len(d.Removed))
+	for _, id := range d.Removed {
+		removed[id] = true
+	}
+	index := map[string]int{}
+	for _, p := range base.Players {
+		if !removed[p.ID] {
+			index[p.ID] = len(out.Players)
+			out.Players = append(out.Players, p)
+		}
+	}
+	for _, pd := range d.Players {
+		i, ok := index[pd.ID]
+		if !ok {
+			i = len(out.Players)
+			out.Players = append(out.Players, PlayerFrame{ID: pd.ID})
+		}
+		p := &out.Players[i]
+		if pd.X != nil {
+			p.X = *pd.X
+		}
+		if pd.Y != nil {
+			p.Y = *pd.Y
+		}
+		if pd.Dir != nil {
+			p.Dir = *pd.Dir
+		}
+		if pd.HP != nil {
+			p.HP = *pd.HP
+		}
+		if pd.Score != nil {
+			p.Score = *pd.Score
+		}
+		if pd.Ack != nil {
+			p.Ack = *pd.Ack
+		}
+	}
+	return out
+}
+
+// deltaState is what a room knows about a delta client's snapshots.
+type deltaState struct {
+	c *Client
+	// ack is the newest acked tick, keyframe the tick of the last keyframe
+	ack      uint64
+	keyframe uint64
+}
+
+// stateMsgs encodes one tick's state for every member, sharing the
+// encodings between clients that get the same message.
+type stateMsgs struct {
+	state GameState
+	// full is the legacy game_state (with names), key the keyframe
+	full, fullBin []byte
+	key, keyBin   []byte
+	deltas        map[uint64][]byte
+	deltasBin     map[uint64][]byte
+}
+
+// sendStates sends this tick's state to the members and keeps it as a
+// baseline.
+func (r *Room) sendStates(state GameState) {
+	if r.snapshots == nil {
+		r.snapshots = make([]GameState, keyframeTicks)
+	}
+	r.snapshots[state.Tick%keyframeTicks] = state
+
+	m := &stateMsgs{state: state}
+	for _, c := range r.members {
+		if !c.delta {
+			if c.binary {
+				r.hub.sendSnapshot(c, "game_state", outMsg{data: m.legacyBinary(), binary: true})
+			} else {
+				r.hub.sendSnapshot(c, "game_state", outMsg{data: m.legacy()})
+			}
+			continue
+		}
+		ds := r.deltas[c.id]
+		if ds == nil || ds.c != c {
+			ds = &deltaState{c: c}
+			r.deltas[c.id] = ds
+		}
+		base, ok := r.baseline(ds)
+		if !ok || state.Tick-ds.keyframe >= keyframeTicks {
+			ds.keyframe = state.Tick
+			r.hub.sendSnapshot(c, "game_state", m.keyframe(c.binary))
+			continue
+		}
+		r.hub.sendSnapshot(c, "game_state", m.delta(base, c.binary))
+	}
+}
+
+// baseline returns the snapshot ds acked last, if the room still has it.
+func (r *Room) baseline(ds *deltaState) (GameState, bool) {
+	if ds.ack == 0 || r.snapshots == nil {
+		return GameState{}, false
+	}
+	base := r.snapshots[ds.ack%keyframeTicks]
+	return base, base.Tick == ds.ack
+}
+
+// ackState records that c received the snapshot of tick.
+func (r *Room) ackState(c *Client, tick uint64) {
+	ds := r.deltas[c.id]
+	if ds == nil || ds.c != c || tick <= ds.ack || tick > r.now() {
+		return
+	}
+	ds.ack = tick
+}
+
+func (m *stateMsgs) legacy() []byte {
+	if m.full == nil {
+		m.full, _ = json.Marshal(Envelope{Type: "game_state", Payload: mustJSON(m.state)})
+	}
+	return m.full
+}
+
+func (m *stateMsgs) legacyBinary() []byte {
+	if m.fullBin == nil {
+		m.fullBin = EncodeGameStateBinary(m.state)
+	}
+	return m.fullBin
+}
+
+func (m *stateMsgs) keyframe(binary bool) outMsg {
+	if binary {
+		// binary frames never had names
+		return outMsg{data: m.legacyBinary(), binary: true}
+	}
+	if m.key == nil {
+		gs := GameState{Tick: m.state.Tick, Players: make([]PlayerFrame, len(m.state.Players))}
+		copy(gs.Players, m.state.Players)
+		for i := range gs.Players {
+			gs.Players[i].Name = ""
+		}
+		m.key, _ = json.Marshal(Envelope{Type: "game_state", Payload: mustJSON(gs)})
+	}
+	return outMsg{data: m.key}
+}
+
+func (m *stateMsgs) delta(base GameState, binary bool) outMsg {
+	if binary {
+		if b, ok := m.deltasBin[base.Tick]; ok {
+			return outMsg{data: b, binary: true}
+		}
+		// diff what the client decoded, so changes below the binary
+		// resolution are not sent
+		b := EncodeGameDeltaBinary(DiffGameState(quantizeState(base), quantizeState(m.state)))
+		if m.deltasBin == nil {
+			m.deltasBin = map[uint64][]byte{}
+		}
+		m.deltasBin[base.Tick] = b
+		return outMsg{data: b, binary: true}
+	}
+	if b, ok := m.deltas[base.Tick]; ok {
+		return outMsg{data: b}
+	}
+	b, _ := json.Marshal(Envelope{Type: "game_delta", Payload: mustJSON(DiffGameState(base, m.state))})
+	if m.deltas == nil {
+		m.deltas = map[uint64][]byte{}
+	}
+	m.deltas[base.Tick] = b
+	return outMsg{data: b}
+}
@@ -0,0 +1,227 @@
+package game
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sameState compares states regardless of player order, which a delta
+// does not keep for players that joined.
+func sameState(a, b GameState) bool {
+	sorted := func(gs GameState) []PlayerFrame {
+		out := append([]PlayerFrame{}, gs.Players...)
+		sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+		return out
+	}
+	return a.Tick == b.Tick && reflect.DeepEqual(sorted(a), sorted(b))
+}
+
+func TestDiffApply(t *testing.T) {
+	a := PlayerFrame{ID: "a", X: 2.5, Y: 2.5, Dir: 0.5, HP: 100, Score: 1, Ack: 10}
+	b := PlayerFrame{ID: "b", X: 13.5, Y: 8.5, Dir: -1, HP: 40, Score: 0, Ack: 3}
+	moved := a
+	moved.X, moved.Ack = 2.6, 11
+	hit := b
+	hit.HP = 20
+	c := PlayerFrame{ID: "c", X: 2.5, Y: 8.5, HP: 100}
+
+	tests := []struct {
+		name      string
+		base, cur []PlayerFrame
+		// fields is the number of fields the delta carries
+		fields  int
+		removed []string
+	}{
+		{name: "unchanged", base: []PlayerFrame{a, b}, cur: []PlayerFrame{a, b}},
+		{name: "one moved", base: []PlayerFrame{a, b}, cur: []PlayerFrame{moved, b}, fields: 2},
+		{name: "both changed", base: []PlayerFrame{a, b}, cur: []PlayerFrame{moved, hit}, fields: 3},
+		{name: "reordered", base: []PlayerFrame{a, b}, cur: []PlayerFrame{b, a}},
+		{name: "joined", base: []PlayerFrame{a}, cur: []PlayerFrame{a, c}, fields: 6},
+		{name: "joined first", base: []PlayerFrame{a}, cur: []PlayerFrame{c, a}, fields: 6},
+		{name: "left", base: []PlayerFrame{a, b}, cur: []PlayerFrame{b}, removed: []string{"a"}},
+		{name: "left and joined", base: []PlayerFrame{a, b}, cur: []PlayerFrame{c, hit}, fields: 7, removed: []string{"a"}},
+		{name: "from empty", base: nil, cur: []PlayerFrame{a, b}, fields: 12},
+		{name: "to empty", base: []PlayerFrame{a, b}, cur: []PlayerFrame{}, removed: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		base := GameState{Tick: 5, Players: tt.base}
+		cur := GameState{Tick: 9, Players: tt.cur}
+		d := DiffGameState(base, cur)
+		if d.Tick != 9 || d.Base != 5 {
+			t.Errorf("%s: delta %d→%d, want 5→9", tt.name, d.Base, d.Tick)
+		}
+		fields := 0
+		for _, p := range d.Players {
+			for _, set := range []bool{p.X != nil, p.Y != nil, p.Dir != nil, p.HP != nil, p.Score != nil, p.Ack != nil} {
+				if set {
+					fields++
+				}
+			}
+		}
+		if fields != tt.fields || !reflect.DeepEqual(d.Removed, tt.removed) {
+			t.Errorf("%s: %d fields, removed %v; want %d, %v", tt.name, fields, d.Removed, tt.fields, tt.removed)
+		}
+
+		basePlayers := slices.Clone(tt.base)
+		got := ApplyGameDelta(base, d)
+		if !sameState(got, cur) {
+			t.Errorf("%s: applied\n got %+v\nwant %+v", tt.name, got, cur)
+		}
+		if !reflect.DeepEqual(base.Players, basePlayers) {
+			t.Errorf("%s: applying modified the baseline", tt.name)
+		}
+
+		// and through JSON, as a JSON client gets it
+		var wire GameDelta
+		if err := json.Unmarshal(mustJSON(d), &wire); err != nil {
+			t.Fatal(err)
+		}
+		if got := ApplyGameDelta(base, wire); !sameState(got, cur) {
+			t.Errorf("%s: applied from JSON\n got %+v\nwant %+v", tt.name, got, cur)
+		}
+	}
+}
+
+func TestGameDeltaBinaryRoundTrip(t *testing.T) {
+	for i := range testStates {
+		for j := range testStates {
+			base, cur := decoded(testStates[i]), decoded(testStates[j])
+			d := DiffGameState(base, cur)
+			b := EncodeGameDeltaBinary(d)
+			got, err := DecodeGameDeltaBinary(b)
+			if err != nil {
+				t.Fatalf("%d→%d: %v", i, j, err)
+			}
+			if !reflect.DeepEqual(got, d) {
+				t.Errorf("%d→%d: delta\n got %+v\nwant %+v", i, j, got, d)
+			}
+			if applied := ApplyGameDelta(base, got); !sameState(applied, cur) {
+				t.Errorf("%d→%d: applied\n got %+v\nwant %+v", i, j, applied, cur)
+			}
+			for n := 0; n < len(b); n++ {
+				if _, err := DecodeGameDeltaBinary(b[:n]); err == nil {
+					t.Errorf("%d→%d: %d of %d bytes decoded", i, j, n, len(b))
+				}
+			}
+		}
+	}
+}
+
+// TestSendStatesKeyframes plays a delta client through a room: it must be
+// able to rebuild every tick's state from what it gets, and get a keyframe
+// whenever it has no usable baseline or went keyframeTicks without one.
+func TestSendStatesKeyframes(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		h := NewHub(Config{})
+		// the test steps the room; its ticker never fires
+		h.tick = time.Hour
+		r := NewRoom("r_delta", "delta", "a")
+		h.startRoom(r)
+		c := &Client{id: "a", roomID: r.id, delta: true, binary: binary, queue: newSendQueue(), closing: make(chan struct{})}
+		must(t, r.call(func() {
+			r.AddPlayer("a", "alice")
+			r.AddPlayer("b", "bob")
+			r.members["a"] = c
+			h.beginMatch()
+			r.Start()
+		}))
+
+		// the client's view: the states it rebuilt, by tick
+		states := map[uint64]GameState{}
+		var ack, keyframe uint64
+		deltas := 0
+		for seq := uint32(1); seq <= 120; seq++ {
+			var state GameState
+			must(t, r.call(func() {
+				r.SetInput("a", InputReq{Seq: seq, Forward: true, Turn: 0.1})
+				r.SetInput("b", InputReq{Seq: seq, Left: seq%20 < 10, Right: seq%20 >= 10, Shoot: seq%7 == 0})
+				r.Tick()
+				state = r.GameState()
+				r.sendStates(state)
+			}))
+			tick := state.Tick
+			msg, ok := c.queue.pop()
+			if !ok {
+				t.Fatalf("tick %d: nothing sent", tick)
+			}
+
+			key, delta := decodeStateMsg(t, msg)
+			wantKey := ack == 0 || tick-ack >= keyframeTicks || tick-keyframe >= keyframeTicks
+			if (key != nil) != wantKey {
+				t.Fatalf("binary %v, tick %d (acked %d, keyframe %d): keyframe %v, want %v", binary, tick, ack, keyframe, key != nil, wantKey)
+			}
+			var got GameState
+			if key != nil {
+				got, keyframe = *key, tick
+			} else {
+				deltas++
+				if delta.Base != ack {
+					t.Fatalf("tick %d: delta against %d, the client acked %d", tick, delta.Base, ack)
+				}
+				got = ApplyGameDelta(states[delta.Base], *delta)
+			}
+			want := GameState{Tick: tick, Players: append([]PlayerFrame{}, state.Players...)}
+			for i := range want.Players {
+				want.Players[i].Name = ""
+			}
+			if binary {
+				want = quantizeState(want)
+			}
+			if !sameState(got, want) {
+				t.Fatalf("binary %v, tick %d: client has\n%+v\nwant\n%+v", binary, tick, got, want)
+			}
+			states[tick] = got
+
+			// the client stops acking for a while, so its baseline falls
+			// out of the room's history
+			if tick < 10 || tick >= 60 {
+				must(t, r.call(func() { r.ackState(c, tick) }))
+				ack = tick
+			}
+		}
+		if deltas == 0 {
+			t.Fatal("no deltas sent")
+		}
+		must(t, r.call(r.close))
+	}
+}
+
+// decodeStateMsg decodes a game_state (the keyframe) or game_delta message.
+func decodeStateMsg(t *testing.T, msg outMsg) (*GameState, *GameDelta) {
+	t.Helper()
+	if msg.binary {
+		if len(msg.data) > 1 && msg.data[1] == binKindGameDelta {
+			d, err := DecodeGameDeltaBinary(msg.data)
+			must(t, err)
+			return nil, &d
+		}
+		gs, err := DecodeGameStateBinary(msg.data)
+		must(t, err)
+		return &gs, nil
+	}
+	var env Envelope
+	must(t, json.Unmarshal(msg.data, &env))
+	switch env.Type {
+	case "game_state":
+		var gs GameState
+		must(t, json.Unmarshal(env.Payload, &gs))
+		return &gs, nil
+	case "game_delta":
+		var d GameDelta
+		must(t, json.Unmarshal(env.Payload, &d))
+		return nil, &d
+	}
+	t.Fatalf("unexpected %s message", env.Type)
+	return nil, nil
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
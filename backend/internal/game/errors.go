@@ -0,0 +1,47 @@
+package game
+
+// Error is a failed request, sent to the client as an error message that
+// echoes the request id. Code is stable and meant for programs; Message is
+// for people and may change. Version 1 clients only look at Message, so
+// existing messages are kept as they were.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+var (
+	errInvalidJSON          = &Error{"invalid_json", "invalid json"}
+	errInvalidPayload       = &Error{"invalid_payload", "invalid payload"}
+	errUnknownType          = &Error{"unknown_type", "unknown type"}
+	errNotAuthenticated     = &Error{"not_authenticated", "send hello first"}
+	errAlreadyAuthenticated = &Error{"already_authenticated", "already authenticated"}
+	errNameRequired         = &Error{"name_required", "name required"}
+	errTokenRequired        = &Error{"token_required", "token required"}
+	errResumeFailed         = &Error{"resume_failed", "resume failed"}
+	errBinaryNotNegotiated  = &Error{"binary_not_negotiated", "binary encoding not negotiated"}
+	errUnsupportedBinary    = &Error{"unsupported_binary", "unsupported binary message"}
+	errShuttingDown         = &Error{"server_shutting_down", "server shutting down"}
+	errAlreadyInRoom        = &Error{"already_in_room", "already in room"}
+	errRoomNotFound         = &Error{"room_not_found", "room not found"}
+	errNotInRoom            = &Error{"not_in_room", "not in room"}
+	errRoomStarted          = &Error{"room_started", "room already started"}
+	errRoomFull             = &Error{"room_full", "room is full"}
+	errWrongPassword        = &Error{"wrong_password", "wrong room password"}
+	errNoSpectators         = &Error{"spectators_disabled", "room does not allow spectators"}
+	errNotHostStart         = &Error{"not_host", "only host can start"}
+	errNotHostConfig        = &Error{"not_host", "only host can config"}
+	errNotHost              = &Error{"not_host", "only host can do that"}
+	errUserRequired         = &Error{"user_required", "user id required"}
+	errNoSuchPlayer         = &Error{"player_not_found", "player not in room"}
+	errSelfTarget           = &Error{"invalid_target", "cannot target yourself"}
+	errBanned               = &Error{"banned", "banned from this room"}
+	errNotReady             = &Error{"not_ready", "everyone must be ready"}
+	errRateLimited          = &Error{"rate_limited", "too many requests"}
+	errMuted                = &Error{"muted", "muted for flooding"}
+)
+
+// codeUnsupportedVersion is the code of the error sent before closing a
+// client with closeVersion.
+const codeUnsupportedVersion = "unsupported_version"
@@ -0,0 +1,194 @@
+package game
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// Message is an inbound client message on its way to its handler.
+type Message struct {
+	Type string
+	// ID is the client's request id, echoed on replies
+	ID      string
+	Payload json.RawMessage
+
+	// req is the already decoded request, e.g. from a binary frame; the
+	// handler then skips decoding Payload
+	req any
+}
+
+// HandlerFunc handles one inbound message.
+type HandlerFunc func(c *Client, m *Message)
+
+// Middleware wraps message handling, e.g. for logging, metrics or rate
+// limiting. It sees every text and binary message, including ones with an
+// unknown type, before the auth check.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// routeFlags tune how a registered message type is handled.
+type routeFlags int
+
+const (
+	// needHello rejects the message until the client has sent hello.
+	needHello routeFlags = 1 << iota
+	// quiet drops malformed payloads without an error reply, for
+	// messages sent every frame.
+	quiet
+)
+
+type route struct {
+	flags routeFlags
+	fn    HandlerFunc
+}
+
+// validator is implemented by requests that check their own fields after
+// decoding.
+type validator interface {
+	validate() *Error
+}
+
+// handle registers fn for messages of type typ with a payload decoded
+// into T. An empty payload leaves T at its zero value. id is the request
+// id to put on direct replies; an error fn returns is sent back with it.
+func handle[T any](h *Hub, typ string, flags routeFlags, fn func(c *Client, id string, req T) error) {
+	h.routes[typ] = route{
+		flags: flags,
+		fn: func(c *Client, m *Message) {
+			req, ok := m.req.(T)
+			if !ok && len(m.Payload) > 0 && string(m.Payload) != "null" {
+				if json.Unmarshal(m.Payload, &req) != nil {
+					h.failed(c, m, flags, errInvalidPayload)
+					return
+				}
+			}
+			if v, ok := any(req).(validator); ok {
+				if err := v.validate(); err != nil {
+					h.failed(c, m, flags, err)
+					return
+				}
+			}
+			if err := fn(c, m.ID, req); err != nil {
+				h.failed(c, m, flags, err)
+			}
+		},
+	}
+}
+
+func (h *Hub) failed(c *Client, m *Message, flags routeFlags, err error) {
+	if flags&quiet == 0 {
+		h.sendError(c, m.ID, err)
+	}
+}
+
+// Use adds middleware around every message handler; the first added runs
+// outermost. It must be called before the hub serves connections.
+func (h *Hub) Use(mw ...Middleware) {
+	h.middleware = append(h.middleware, mw...)
+	next := HandlerFunc(h.route)
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		next = h.middleware[i](next)
+	}
+	h.dispatch = next
+}
+
+// route runs the handler registered for m.Type.
+func (h *Hub) route(c *Client, m *Message) {
+	r, ok := h.routes[m.Type]
+	if !ok {
+		h.reply(c, m.ID, "error", ErrorMsg{
+			Code:    errUnknownType.Code,
+			Message: errUnknownType.Message,
+			Type:    m.Type,
+		})
+		return
+	}
+	if r.flags&needHello != 0 && c.name == "" {
+		h.sendError(c, m.ID, errNotAuthenticated)
+		return
+	}
+	r.fn(c, m)
+}
+
+func (h *Hub) registerHandlers() {
+	handle(h, "hello", 0, h.handleHello)
+	handle(h, "resume", 0, h.handleResume)
+	handle(h, "rooms_list", needHello, func(c *Client, id string, _ struct{}) error {
+		h.sendRooms(c, id)
+		return nil
+	})
+	handle(h, "room_create", needHello, func(c *Client, id string, req RoomCreateReq) error {
+		return h.handleRoomCreate(c, id, req)
+	})
+	handle(h, "room_join", needHello, func(c *Client, id string, req RoomJoinReq) error {
+		return h.handleRoomJoin(c, id, req)
+	})
+	handle(h, "room_leave", needHello, func(c *Client, _ string, _ struct{}) error {
+		h.handleRoomLeave(c)
+		return nil
+	})
+	handle(h, "room_ready", needHello, func(c *Client, _ string, req RoomReadyReq) error {
+		return h.handleRoomReady(c, req.Ready)
+	})
+	handle(h, "room_start", needHello, func(c *Client, _ string, req RoomStartReq) error {
+		return h.handleRoomStart(c, req)
+	})
+	handle(h, "room_rematch", needHello, func(c *Client, _ string, _ struct{}) error {
+		return h.handleRoomRematch(c)
+	})
+	handle(h, "room_config", needHello, func(c *Client, _ string, req RoomConfigReq) error {
+		return h.handleRoomConfig(c, req)
+	})
+	handle(h, "room_kick", needHello, func(c *Client, _ string, req RoomTargetReq) error {
+		return h.handleRoomKick(c, req.UserID, false)
+	})
+	handle(h, "room_ban", needHello, func(c *Client, _ string, req RoomTargetReq) error {
+		return h.handleRoomKick(c, req.UserID, true)
+	})
+	handle(h, "room_transfer_host", needHello, func(c *Client, _ string, req RoomTargetReq) error {
+		return h.handleRoomTransferHost(c, req.UserID)
+	})
+	handle(h, "input", needHello|quiet, func(c *Client, _ string, req InputReq) error {
+		h.handleInput(c, req)
+		return nil
+	})
+	handle(h, "state_ack", needHello|quiet, func(c *Client, _ string, req StateAckReq) error {
+		h.handleStateAck(c, req.Tick)
+		return nil
+	})
+	handle(h, "chat_send", needHello, func(c *Client, _ string, req ChatSendReq) error {
+		return h.handleChatSend(c, req.Text)
+	})
+	// app-level ping/pong (RTT measurement)
+	handle(h, "ping", quiet, func(c *Client, id string, req PingReq) error {
+		h.reply(c, id, "pong", PongMsg{T: req.T})
+		return nil
+	})
+}
+
+func (r HelloReq) validate() *Error {
+	if r.Name == "" {
+		return errNameRequired
+	}
+	return nil
+}
+
+func (r RoomTargetReq) validate() *Error {
+	if r.UserID == "" {
+		return errUserRequired
+	}
+	return nil
+}
+
+func (r ResumeReq) validate() *Error {
+	if r.Token == "" {
+		return errTokenRequired
+	}
+	return nil
+}
+
+func (r InputReq) validate() *Error {
+	if math.IsNaN(r.Turn) || math.IsInf(r.Turn, 0) {
+		return errInvalidPayload
+	}
+	return nil
+}
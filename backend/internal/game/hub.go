@@ -2,6 +2,7 @@ package game
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sync"
@@ -10,34 +11,106 @@ import (
 	"fps-backend/internal/ws"
 )
 
+// Close codes sent to clients when the server drops them. The frontend maps
+// these to user facing messages.
+const (
+	// closeKicked drops a client the server removed, e.g. for being AFK
+	closeKicked   = 4000
+	closeReplaced = 4001
+	closeSlow     = 4002
+	// closeVersion rejects a client whose protocol version the server
+	// cannot speak
+	closeVersion = 4003
+	// closeFlood drops a client that keeps exceeding its rate limits
+	closeFlood    = 4004
+	closeShutdown = ws.CloseGoingAway
+	closeProtocol = ws.CloseProtocolError
+	closeTooLarge = ws.CloseMessageTooBig
+)
+
+const closeTimeout = 2 * time.Second
+
 type Hub struct {
-	tick time.Duration
+	cfg      Config
+	tick     time.Duration
+	upgrader ws.Upgrader
 
 	mu      sync.Mutex
 	clients map[string]*Client
 	rooms   map[string]*Room
+	// sessions maps resume tokens to the user they restore
+	sessions map[string]*session
+
+	// draining is set by Shutdown; no new rooms, matches or connections
+	draining bool
+	matches  sync.WaitGroup
+
+	// conns counts open connections per remote IP, see acquireConn
+	conns map[string]int
+
+	stats hubStats
+
+	// routes maps message types to handlers, see handlers.go; dispatch
+	// is the route lookup wrapped in the middleware
+	routes     map[string]route
+	middleware []Middleware
+	dispatch   HandlerFunc
 }
 
-func NewHub(tick time.Duration) *Hub {
-	return &Hub{
-		tick:    tick,
-		clients: map[string]*Client{},
-		rooms:   map[string]*Room{},
-	}
+func NewHub(cfg Config) *Hub {
+	cfg = cfg.withDefaults()
+	h := &Hub{
+		cfg:  cfg,
+		tick: cfg.Tick,
+		upgrader: ws.Upgrader{
+			AllowedOrigins: cfg.AllowedOrigins,
+			Subprotocols:   cfg.Subprotocols,
+			Compression:    cfg.Compression,
+		},
+		clients:  map[string]*Client{},
+		rooms:    map[string]*Room{},
+		sessions: map[string]*session{},
+		routes:   map[string]route{},
+		conns:    map[string]int{},
+	}
+	h.registerHandlers()
+	h.Use(h.rateLimit)
+	go h.janitor()
+	return h
 }
 
 func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := ws.Upgrade(w, r)
+	if h.Draining() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ip := remoteIP(r)
+	if !h.acquireConn(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer h.releaseConn(ip)
+
+	conn, err := h.upgrader.Upgrade(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		// Upgrade has already answered with the matching HTTP status
 		return
 	}
+	// game_state snapshots are repetitive JSON and compress well
+	conn.EnableWriteCompression(true)
+	conn.SetIdleTimeout(h.cfg.IdleTimeout)
+	conn.SetWriteTimeout(h.cfg.WriteTimeout)
 
 	client := &Client{
-		id:   newID("u_"),
-		conn: conn,
-		send: make(chan []byte, 64),
+		id:      newID("u_"),
+		conn:    conn,
+		queue:   newSendQueue(),
+		closing: make(chan struct{}),
 	}
+	client.lastPong.Store(time.Now().UnixNano())
+	conn.SetPongHandler(func([]byte) {
+		client.lastPong.Store(time.Now().UnixNano())
+	})
 
 	h.mu.Lock()
 	h.clients[client.id] = client
@@ -48,173 +121,240 @@ func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Hub) writeLoop(c *Client) {
-	defer func() {
-		_ = c.conn.Close()
-	}()
-	for msg := range c.send {
-		if err := c.conn.WriteText(msg); err != nil {
+	ping := time.NewTicker(h.cfg.PingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ping.C:
+			// the read loop notices the closed socket and disconnects,
+			// which frees the player's room slot
+			if time.Since(time.Unix(0, c.lastPong.Load())) > h.cfg.PingInterval+h.cfg.PongTimeout {
+				_ = c.conn.Close()
+				return
+			}
+			if err := c.conn.WritePing(nil); err != nil {
+				_ = c.conn.Close()
+				return
+			}
+		case <-c.queue.ready:
+			// one message per wakeup, so pings and closing are not starved
+			// by a long backlog
+			msg, ok := c.queue.pop()
+			if !ok {
+				continue
+			}
+			if err := writeOut(c.conn, msg); err != nil {
+				_ = c.conn.Close()
+				return
+			}
+		case <-c.closing:
+			// flush what is already queued so e.g. a kick notice arrives
+			// before the close frame
+			if err := h.flushSend(c); err != nil {
+				_ = c.conn.Close()
+				return
+			}
+			_ = c.conn.CloseWithStatus(c.closeCode, c.closeReason, closeTimeout)
 			return
 		}
 	}
 }
 
-func (h *Hub) readLoop(c *Client) {
-	defer h.disconnect(c)
+func (h *Hub) flushSend(c *Client) error {
+	for {
+		msg, ok := c.queue.pop()
+		if !ok {
+			return nil
+		}
+		if err := writeOut(c.conn, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func writeOut(conn *ws.Conn, msg outMsg) error {
+	if msg.binary {
+		return conn.WriteBinary(msg.data)
+	}
+	return conn.WriteText(msg.data)
+}
 
+func (h *Hub) readLoop(c *Client) {
 	for {
-		text, err := c.conn.ReadText()
+		typ, text, err := c.conn.ReadMessage()
 		if err != nil {
+			code, reason := readErrorClose(err)
+			h.disconnect(c, code, reason)
 			return
 		}
+		if typ == ws.BinaryMessage {
+			h.handleBinary(c, text)
+			continue
+		}
 
 		var env Envelope
 		if err := json.Unmarshal(text, &env); err != nil {
-			h.sendError(c, "invalid json")
+			h.rejectFrame(c, errInvalidJSON)
 			continue
 		}
-
-		switch env.Type {
-		case "hello":
-			var req HelloReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil || req.Name == "" {
-				h.sendError(c, "name required")
-				continue
-			}
-			h.handleHello(c, req.Name)
-		case "rooms_list":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			h.sendRooms(c)
-		case "room_create":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req RoomCreateReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil {
-				h.sendError(c, "invalid payload")
-				continue
-			}
-			h.handleRoomCreate(c, req.Name)
-		case "room_join":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req RoomJoinReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil {
-				h.sendError(c, "invalid payload")
-				continue
-			}
-			h.handleRoomJoin(c, req.RoomID)
-		case "room_leave":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			h.handleRoomLeave(c)
-		case "room_ready":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req RoomReadyReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil {
-				h.sendError(c, "invalid payload")
-				continue
-			}
-			h.handleRoomReady(c, req.Ready)
-		case "room_start":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req RoomStartReq
-			if len(env.Payload) > 0 {
-				_ = json.Unmarshal(env.Payload, &req)
-			}
-			h.handleRoomStart(c, req)
-		case "room_config":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req RoomConfigReq
-			if len(env.Payload) > 0 {
-				_ = json.Unmarshal(env.Payload, &req)
-			}
-			h.handleRoomConfig(c, req)
-		case "input":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req InputReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil {
-				continue
-			}
-			h.handleInput(c, req)
-		case "chat_send":
-			if !h.requireAuthed(c) {
-				continue
-			}
-			var req ChatSendReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil {
-				h.sendError(c, "invalid payload")
-				continue
-			}
-			h.handleChatSend(c, req.Text)
-		case "ping":
-			// app-level ping/pong (RTT measurement)
-			var req PingReq
-			if err := json.Unmarshal(env.Payload, &req); err != nil {
-				continue
-			}
-			h.send(c, "pong", PongMsg{T: req.T})
-		default:
-			h.sendError(c, "unknown type")
-		}
+		h.dispatch(c, &Message{Type: env.Type, ID: env.ID, Payload: env.Payload})
 	}
 }
 
-func (h *Hub) requireAuthed(c *Client) bool {
-	if c.name == "" {
-		h.sendError(c, "send hello first")
-		return false
-	}
-	return true
-}
+func (h *Hub) disconnect(c *Client, code int, reason string) {
+	defer h.closeClient(c, code, reason)
 
-func (h *Hub) disconnect(c *Client) {
 	h.mu.Lock()
+	if h.clients[c.id] != c {
+		// the session was resumed on another connection which now owns
+		// the user id and the room slot
+		h.mu.Unlock()
+		return
+	}
 	delete(h.clients, c.id)
+	room := h.rooms[c.roomID]
+	s := h.sessions[c.token]
+	if s != nil {
+		// lets a resume racing with this disconnect find the room
+		s.roomID = c.roomID
+	}
 	h.mu.Unlock()
 
-	h.handleRoomLeave(c)
-	close(c.send)
-	_ = c.conn.Close()
-}
+	if room != nil && s != nil && h.detach(c, room, s) {
+		return
+	}
 
-func (h *Hub) handleHello(c *Client, name string) {
 	h.mu.Lock()
-	c.name = name
+	if h.clients[c.id] == nil {
+		delete(h.sessions, c.token)
+	}
 	h.mu.Unlock()
+	h.handleRoomLeave(c)
+}
+
+// closeClient asks the client's write loop to flush and run the close
+// handshake. Only the first call has any effect.
+func (h *Hub) closeClient(c *Client, code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.closing)
+	})
+}
 
-	h.send(c, "hello_ack", HelloAck{UserID: c.id, Name: c.name})
-	h.sendRooms(c)
+// readErrorClose picks the close code to answer a failed read with.
+func readErrorClose(err error) (int, string) {
+	var ce *ws.CloseError
+	switch {
+	case errors.As(err, &ce):
+		return ws.CloseNormalClosure, ""
+	case errors.Is(err, ws.ErrMessageTooLarge):
+		return closeTooLarge, "message too large"
+	case errors.Is(err, ws.ErrProtocol):
+		return closeProtocol, "protocol error"
+	default:
+		return ws.CloseAbnormal, ""
+	}
 }
 
-func (h *Hub) sendRooms(c *Client) {
+func (h *Hub) handleHello(c *Client, id string, req HelloReq) error {
+	first := c.name == ""
+	if first && !h.negotiate(c, id, req.Version, req.MinVersion, req.Caps, req.Encodings) {
+		return nil
+	}
+
 	h.mu.Lock()
-	rooms := make([]RoomSummary, 0, len(h.rooms))
-	for _, r := range h.rooms {
-		rooms = append(rooms, r.Summary())
+	if first && c.has(CapResume) {
+		c.token = newID("s_")
+		h.sessions[c.token] = &session{token: c.token, userID: c.id}
+	}
+	c.name = req.Name
+	if s := h.sessions[c.token]; s != nil {
+		s.name = c.name
 	}
 	h.mu.Unlock()
 
-	h.send(c, "rooms", RoomsMsg{Rooms: rooms})
+	h.reply(c, id, "hello_ack", h.helloAck(c))
+	h.sendRooms(c, "")
+	return nil
 }
 
-func (h *Hub) broadcastRooms() {
+func (h *Hub) helloAck(c *Client) HelloAck {
+	encoding := EncodingJSON
+	if c.binary {
+		encoding = EncodingBinaryV1
+	}
+	return HelloAck{
+		UserID:      c.id,
+		Name:        c.name,
+		Version:     c.version,
+		Caps:        serverCaps,
+		Encoding:    encoding,
+		ResumeToken: c.token,
+	}
+}
+
+// negotiate fixes c's protocol version and capabilities, or rejects and
+// closes an incompatible client.
+func (h *Hub) negotiate(c *Client, id string, version, minVersion int, caps, legacy []string) bool {
+	v, enabled, err := negotiateProtocol(version, minVersion, caps, legacy)
+	if err != nil {
+		h.sendError(c, id, err)
+		h.closeClient(c, closeVersion, "unsupported protocol version")
+		return false
+	}
+	c.version = v
+	c.caps = enabled
+	c.binary = c.has(CapBinaryV1)
+	c.delta = c.has(CapDeltaV1)
+	return true
+}
+
+// handleBinary dispatches a binary frame. Only the hot-path messages have a
+// binary form, and only after the client negotiated it in hello.
+func (h *Hub) handleBinary(c *Client, b []byte) {
+	if !c.binary {
+		h.rejectFrame(c, errBinaryNotNegotiated)
+		return
+	}
+	if len(b) < 2 || b[0] != binaryVersion1 {
+		h.rejectFrame(c, errUnsupportedBinary)
+		return
+	}
+	switch b[1] {
+	case binKindInput:
+		req, err := DecodeInputBinary(b)
+		if err != nil {
+			h.rejectFrame(c, errInvalidPayload)
+			return
+		}
+		h.dispatch(c, &Message{Type: "input", req: req})
+	default:
+		h.rejectFrame(c, errUnsupportedBinary)
+	}
+}
+
+func (h *Hub) sendRooms(c *Client, id string) {
+	h.reply(c, id, "rooms", RoomsMsg{Rooms: h.roomSummaries()})
+}
+
+func (h *Hub) roomSummaries() []RoomSummary {
 	h.mu.Lock()
+	defer h.mu.Unlock()
 	rooms := make([]RoomSummary, 0, len(h.rooms))
 	for _, r := range h.rooms {
-		rooms = append(rooms, r.Summary())
+		if s := r.summary.Load(); !s.private {
+			rooms = append(rooms, *s)
+		}
 	}
+	return rooms
+}
+
+func (h *Hub) broadcastRooms() {
+	rooms := h.roomSummaries()
+
+	h.mu.Lock()
 	clients := make([]*Client, 0, len(h.clients))
 	for _, c := range h.clients {
 		if c.name != "" && c.roomID == "" {
@@ -225,183 +365,326 @@ func (h *Hub) broadcastRooms() {
 
 	msg, _ := json.Marshal(Envelope{Type: "rooms", Payload: mustJSON(RoomsMsg{Rooms: rooms})})
 	for _, c := range clients {
-		h.trySendRaw(c, msg)
+		h.sendSnapshot(c, "rooms", outMsg{data: msg})
 	}
 }
 
-func (h *Hub) handleRoomCreate(c *Client, name string) {
+// clientRoom returns the room c is in, or nil.
+func (h *Hub) clientRoom(c *Client) *Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rooms[c.roomID]
+}
+
+func (h *Hub) handleRoomCreate(c *Client, id string, req RoomCreateReq) error {
+	name := req.Name
 	if name == "" {
 		name = "Room"
 	}
 
 	h.mu.Lock()
+	if h.draining {
+		h.mu.Unlock()
+		return errShuttingDown
+	}
 	if c.roomID != "" {
 		h.mu.Unlock()
-		h.sendError(c, "already in room")
-		return
+		return errAlreadyInRoom
 	}
 	room := NewRoom(newID("r_"), name, c.id)
+	room.ConfigureAccess(&req.MaxPlayers, &req.Private, &req.Password)
+	// the creator joins with the password as stored, i.e. trimmed
+	password := room.password
+	h.startRoom(room)
 	h.rooms[room.id] = room
 	h.mu.Unlock()
 
-	h.handleRoomJoin(c, room.id)
-	h.broadcastRooms()
+	return h.handleRoomJoin(c, id, RoomJoinReq{RoomID: room.id, Password: password})
 }
 
-func (h *Hub) handleRoomJoin(c *Client, roomID string) {
+// handleRoomJoin adds c to a room as a player, or as a spectator if
+// req.Spectate is set. Players can join a running match only if the room
+// allows late joiners; they start at a spawn point with no score.
+func (h *Hub) handleRoomJoin(c *Client, id string, req RoomJoinReq) error {
 	h.mu.Lock()
-	room, ok := h.rooms[roomID]
+	room, ok := h.rooms[req.RoomID]
+	inRoom := c.roomID != ""
+	h.mu.Unlock()
 	if !ok {
-		h.mu.Unlock()
-		h.sendError(c, "room not found")
-		return
+		return errRoomNotFound
 	}
-	if room.started {
-		h.mu.Unlock()
-		h.sendError(c, "room already started")
-		return
+	if inRoom {
+		return errAlreadyInRoom
 	}
-	if c.roomID != "" {
-		h.mu.Unlock()
-		h.sendError(c, "already in room")
-		return
+
+	var err error
+	if room.call(func() {
+		switch {
+		case room.Banned(c.id):
+			err = errBanned
+			return
+		case !room.CheckPassword(req.Password):
+			err = errWrongPassword
+			return
+		case req.Spectate:
+			if !room.allowSpectators {
+				err = errNoSpectators
+				return
+			}
+			room.AddSpectator(c.id, c.name)
+		case !room.CanJoin():
+			err = errRoomStarted
+			return
+		case room.Full():
+			err = errRoomFull
+			return
+		default:
+			room.AddPlayer(c.id, c.name)
+		}
+		room.members[c.id] = c
+		delete(room.deltas, c.id)
+		h.reply(c, id, "room_state", room.State())
+		room.broadcastState()
+		if room.ticking() {
+			h.send(c, "game_start", h.gameStart(room))
+		}
+		room.publish()
+	}) != nil {
+		return errRoomNotFound
 	}
-	room.AddPlayer(c.id, c.name)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
 	c.roomID = room.id
-	state := room.State()
 	h.mu.Unlock()
-
-	h.send(c, "room_state", state)
-	h.broadcastRoom(room.id)
 	h.broadcastRooms()
+	return nil
 }
 
 func (h *Hub) handleRoomLeave(c *Client) {
 	h.mu.Lock()
-	roomID := c.roomID
-	if roomID == "" {
-		h.mu.Unlock()
-		return
-	}
-	room, ok := h.rooms[roomID]
-	if !ok {
-		c.roomID = ""
-		h.mu.Unlock()
-		return
-	}
-	room.RemovePlayer(c.id)
+	room := h.rooms[c.roomID]
 	c.roomID = ""
-	shouldDelete := len(room.players) == 0
-	if shouldDelete {
-		delete(h.rooms, room.id)
-	}
 	h.mu.Unlock()
 
-	if shouldDelete {
-		h.broadcastRooms()
-		return
+	if room != nil {
+		_ = room.do(func() {
+			if room.members[c.id] == c {
+				room.removePlayer(c.id)
+			}
+		})
 	}
-	h.broadcastRoom(roomID)
-	h.broadcastRooms()
 }
 
-func (h *Hub) handleRoomReady(c *Client, ready bool) {
+// removePlayer takes a player that has no live connection out of a room.
+func (h *Hub) removePlayer(roomID, userID string) {
 	h.mu.Lock()
-	room, ok := h.rooms[c.roomID]
-	if !ok {
-		h.mu.Unlock()
-		return
-	}
-	room.SetReady(c.id, ready)
+	room := h.rooms[roomID]
 	h.mu.Unlock()
-	h.broadcastRoom(room.id)
+
+	if room != nil {
+		_ = room.do(func() {
+			if room.members[userID] == nil {
+				room.removePlayer(userID)
+			}
+		})
+	}
 }
 
-func (h *Hub) handleRoomStart(c *Client, req RoomStartReq) {
-	h.mu.Lock()
-	room, ok := h.rooms[c.roomID]
-	if !ok {
-		h.mu.Unlock()
-		return
+func (h *Hub) handleRoomReady(c *Client, ready bool) error {
+	room := h.clientRoom(c)
+	if room == nil {
+		return errNotInRoom
 	}
-	if room.hostID != c.id {
-		h.mu.Unlock()
-		h.sendError(c, "only host can start")
-		return
+	_ = room.do(func() {
+		room.SetReady(c.id, ready)
+		room.broadcastState()
+	})
+	return nil
+}
+
+func (h *Hub) handleRoomStart(c *Client, req RoomStartReq) error {
+	room := h.clientRoom(c)
+	if room == nil {
+		return errNotInRoom
 	}
-	if room.started {
-		h.mu.Unlock()
-		return
+	var err error
+	if room.call(func() {
+		if room.hostID != c.id {
+			err = errNotHostStart
+			return
+		}
+		if room.started {
+			return
+		}
+		if !room.AllReady() {
+			err = errNotReady
+			return
+		}
+		if !h.beginMatch() {
+			err = errShuttingDown
+			return
+		}
+		room.ConfigureForStart(req.WinScore, req.ShowEnemiesOnMap, req.WallText)
+		room.ConfigureJoin(req.AllowLateJoin, req.AllowSpectators)
+		room.Start()
+		gs := h.gameStart(room)
+		if h.cfg.RecordDir != "" {
+			room.startRecording(gs)
+		}
+		room.broadcastState()
+		room.broadcast("game_start", gs)
+		room.announce()
+	}) != nil {
+		return errNotInRoom
 	}
-	if !room.AllReady() {
-		h.mu.Unlock()
-		h.sendError(c, "everyone must be ready")
-		return
+	return err
+}
+
+// handleRoomRematch takes a finished room back to the lobby without waiting
+// for Config.ReturnToLobby. In the lobby it does nothing.
+func (h *Hub) handleRoomRematch(c *Client) error {
+	room := h.clientRoom(c)
+	if room == nil {
+		return errNotInRoom
+	}
+	var err error
+	if room.call(func() {
+		switch {
+		case !room.started:
+		case !room.gameOverSent:
+			err = errRoomStarted
+		default:
+			room.returnToLobby()
+		}
+	}) != nil {
+		return errNotInRoom
 	}
-	room.ConfigureForStart(req.WinScore, req.ShowEnemiesOnMap, req.WallText)
-	room.Start()
-	roomID := room.id
-	h.mu.Unlock()
+	return err
+}
 
-	h.broadcastRoom(roomID)
-	h.broadcastGameStart(roomID)
-	go h.runRoom(roomID)
-	h.broadcastRooms()
+// moderate runs fn on c's room after checking that c is the host and
+// target is someone else in the room.
+func (h *Hub) moderate(c *Client, target string, fn func(room *Room) error) error {
+	room := h.clientRoom(c)
+	if room == nil {
+		return errNotInRoom
+	}
+	var err error
+	if room.call(func() {
+		switch {
+		case room.hostID != c.id:
+			err = errNotHost
+		case target == c.id:
+			err = errSelfTarget
+		case !room.InRoom(target):
+			err = errNoSuchPlayer
+		default:
+			err = fn(room)
+		}
+	}) != nil {
+		return errNotInRoom
+	}
+	return err
 }
 
-func (h *Hub) handleRoomConfig(c *Client, req RoomConfigReq) {
+// handleRoomKick removes a player or spectator from the host's room, and
+// with ban keeps them from coming back.
+func (h *Hub) handleRoomKick(c *Client, target string, ban bool) error {
+	return h.moderate(c, target, func(room *Room) error {
+		if ban {
+			room.Ban(target)
+		}
+		room.kick(target, ban, "")
+		return nil
+	})
+}
+
+// handleRoomTransferHost hands the host role to another connected player.
+func (h *Hub) handleRoomTransferHost(c *Client, target string) error {
+	return h.moderate(c, target, func(room *Room) error {
+		if !room.HasPlayer(target) || room.members[target] == nil {
+			return errNoSuchPlayer
+		}
+		room.hostID = target
+		room.broadcastState()
+		return nil
+	})
+}
+
+// beginMatch registers a running match with Shutdown, unless the hub is
+// already draining.
+func (h *Hub) beginMatch() bool {
 	h.mu.Lock()
-	room, ok := h.rooms[c.roomID]
-	if !ok {
-		h.mu.Unlock()
-		return
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
 	}
-	if room.hostID != c.id {
-		h.mu.Unlock()
-		h.sendError(c, "only host can config")
-		return
+	h.matches.Add(1)
+	return true
+}
+
+func (h *Hub) handleRoomConfig(c *Client, req RoomConfigReq) error {
+	room := h.clientRoom(c)
+	if room == nil {
+		return errNotInRoom
 	}
-	if room.started {
-		h.mu.Unlock()
-		h.sendError(c, "room already started")
+	var err error
+	if room.call(func() {
+		if room.hostID != c.id {
+			err = errNotHostConfig
+			return
+		}
+		if room.started {
+			err = errRoomStarted
+			return
+		}
+		room.ConfigureForStart(req.WinScore, req.ShowEnemiesOnMap, req.WallText)
+		room.ConfigureJoin(req.AllowLateJoin, req.AllowSpectators)
+		room.ConfigureAccess(req.MaxPlayers, req.Private, req.Password)
+		room.broadcastState()
+		room.announce()
+	}) != nil {
+		return errNotInRoom
+	}
+	return err
+}
+
+func (h *Hub) handleInput(c *Client, req InputReq) {
+	room := h.clientRoom(c)
+	if room == nil {
 		return
 	}
-	room.ConfigureForStart(req.WinScore, req.ShowEnemiesOnMap, req.WallText)
-	roomID := room.id
-	h.mu.Unlock()
-
-	h.broadcastRoom(roomID)
-	h.broadcastRooms()
+	req.Turn = clampTurn(req.Turn)
+	_ = room.do(func() {
+		if !room.started || room.finished {
+			return
+		}
+		room.SetInput(c.id, req)
+	})
 }
 
-func (h *Hub) handleInput(c *Client, req InputReq) {
-	h.mu.Lock()
-	room, ok := h.rooms[c.roomID]
-	if !ok || !room.started || room.finished {
-		h.mu.Unlock()
+func (h *Hub) handleStateAck(c *Client, tick uint64) {
+	room := h.clientRoom(c)
+	if room == nil {
 		return
 	}
-	room.SetInput(c.id, req)
-	h.mu.Unlock()
+	_ = room.do(func() {
+		room.ackState(c, tick)
+	})
 }
 
-func (h *Hub) handleChatSend(c *Client, text string) {
+func (h *Hub) handleChatSend(c *Client, text string) error {
 	text = sanitizeChat(text)
 	if text == "" {
-		return
+		return nil
 	}
 
-	h.mu.Lock()
-	roomID := c.roomID
-	if roomID == "" {
-		h.mu.Unlock()
-		h.sendError(c, "not in room")
-		return
-	}
-	_, ok := h.rooms[roomID]
-	if !ok {
-		h.mu.Unlock()
-		return
+	room := h.clientRoom(c)
+	if room == nil {
+		return errNotInRoom
 	}
 	msg := ChatMsg{
 		UserID: c.id,
@@ -409,134 +692,56 @@ func (h *Hub) handleChatSend(c *Client, text string) {
 		Text:   text,
 		TS:     time.Now().UnixMilli(),
 	}
-	h.mu.Unlock()
-
-	h.broadcastChat(roomID, msg)
-}
-
-func (h *Hub) broadcastChat(roomID string, msg ChatMsg) {
-	h.mu.Lock()
-	clients := h.roomClientsLocked(roomID)
-	h.mu.Unlock()
-
-	raw, _ := json.Marshal(Envelope{Type: "chat", Payload: mustJSON(msg)})
-	for _, c := range clients {
-		h.trySendRaw(c, raw)
-	}
-}
-
-func (h *Hub) broadcastRoom(roomID string) {
-	h.mu.Lock()
-	room, ok := h.rooms[roomID]
-	if !ok {
-		h.mu.Unlock()
-		return
-	}
-	state := room.State()
-	clients := h.roomClientsLocked(roomID)
-	h.mu.Unlock()
-
-	msg, _ := json.Marshal(Envelope{Type: "room_state", Payload: mustJSON(state)})
-	for _, c := range clients {
-		h.trySendRaw(c, msg)
-	}
+	_ = room.do(func() {
+		room.broadcast("chat", msg)
+	})
+	return nil
 }
 
-func (h *Hub) broadcastGameStart(roomID string) {
-	h.mu.Lock()
-	room, ok := h.rooms[roomID]
-	if !ok {
-		h.mu.Unlock()
-		return
-	}
-	clients := h.roomClientsLocked(roomID)
-	start := GameStartMsg{
+func (h *Hub) gameStart(room *Room) GameStartMsg {
+	return GameStartMsg{
 		Map:              room.m,
 		TickMS:           int(h.tick / time.Millisecond),
 		WinScore:         room.winScore,
 		ShowEnemiesOnMap: room.showEnemiesOnMap,
 		WallText:         room.wallText,
 	}
-	h.mu.Unlock()
-
-	msg, _ := json.Marshal(Envelope{Type: "game_start", Payload: mustJSON(start)})
-	for _, c := range clients {
-		h.trySendRaw(c, msg)
-	}
 }
 
-func (h *Hub) runRoom(roomID string) {
-	ticker := time.NewTicker(h.tick)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		h.mu.Lock()
-		room, ok := h.rooms[roomID]
-		if !ok || !room.started {
-			h.mu.Unlock()
-			return
-		}
-		room.Tick()
-		state := room.GameState()
-		clients := h.roomClientsLocked(roomID)
-		ended := room.finished && !room.gameOverSent
-		var over GameOverMsg
-		if ended {
-			room.gameOverSent = true
-			over = GameOverMsg{
-				RoomID:   room.id,
-				RoomName: room.name,
-				WinnerID: room.winnerID,
-				WinScore: room.winScore,
-				Rankings: room.Rankings(),
-			}
-		}
-		h.mu.Unlock()
-
-		msg, _ := json.Marshal(Envelope{Type: "game_state", Payload: mustJSON(state)})
-		for _, c := range clients {
-			h.trySendRaw(c, msg)
-		}
-
-		if ended {
-			msg2, _ := json.Marshal(Envelope{Type: "game_over", Payload: mustJSON(over)})
-			for _, c := range clients {
-				h.trySendRaw(c, msg2)
-			}
-			return
-		}
-	}
-}
-
-func (h *Hub) roomClientsLocked(roomID string) []*Client {
-	clients := make([]*Client, 0, 8)
-	for _, c := range h.clients {
-		if c.roomID == roomID && c.name != "" {
-			clients = append(clients, c)
-		}
+// sendError reports a failed request; id is its request id, if any.
+func (h *Hub) sendError(c *Client, id string, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		log.Printf("client %s: %v", c.id, err)
+		e = &Error{Code: "internal", Message: "internal error"}
 	}
-	return clients
+	h.reply(c, id, "error", ErrorMsg{Code: e.Code, Message: e.Message})
 }
 
-func (h *Hub) sendError(c *Client, msg string) {
-	h.send(c, "error", ErrorMsg{Message: msg})
+func (h *Hub) send(c *Client, typ string, payload any) {
+	h.reply(c, "", typ, payload)
 }
 
-func (h *Hub) send(c *Client, typ string, payload any) {
-	env := Envelope{Type: typ, Payload: mustJSON(payload)}
+// reply sends a direct answer to the request with the given id.
+func (h *Hub) reply(c *Client, id, typ string, payload any) {
+	env := Envelope{Type: typ, ID: id, Payload: mustJSON(payload)}
 	raw, err := json.Marshal(env)
 	if err != nil {
 		log.Printf("json marshal: %v", err)
 		return
 	}
-	h.trySendRaw(c, raw)
+	h.sendRaw(c, raw)
 }
 
-func (h *Hub) trySendRaw(c *Client, raw []byte) {
-	select {
-	case c.send <- raw:
-	default:
-	}
+// sendRaw queues an encoded envelope; it is never dropped.
+func (h *Hub) sendRaw(c *Client, raw []byte) {
+	h.enqueue(c, outMsg{data: raw}, "")
+}
+
+// sendSnapshot queues a message of the given kind that supersedes any
+// earlier one of that kind still waiting in the queue.
+func (h *Hub) sendSnapshot(c *Client, kind string, msg outMsg) {
+	h.enqueue(c, msg, kind)
 }
 
 func mustJSON(v any) json.RawMessage {
@@ -0,0 +1,114 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fps-backend/internal/ws"
+)
+
+// startHub serves a hub for cfg on a loopback port and returns its ws://
+// URL.
+func startHub(t testing.TB, cfg Config) (*Hub, string) {
+	t.Helper()
+	h := NewHub(cfg)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return h, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t testing.TB, url string) *ws.Conn {
+	t.Helper()
+	c, _, err := ws.Dial(context.Background(), url, ws.DialOptions{Subprotocols: []string{Subprotocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func sendMsg(t testing.TB, c *ws.Conn, typ string, payload any) {
+	t.Helper()
+	b, _ := json.Marshal(Envelope{Type: typ, Payload: mustJSON(payload)})
+	if err := c.WriteText(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMsg returns the payload of the next message of type typ.
+func readMsg(t testing.TB, c *ws.Conn, typ string) json.RawMessage {
+	t.Helper()
+	for {
+		b, err := c.ReadText()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		var env Envelope
+		if json.Unmarshal(b, &env) == nil && env.Type == typ {
+			return env.Payload
+		}
+	}
+}
+
+func TestMalformedBinaryInputIsRateLimited(t *testing.T) {
+	_, url := startHub(t, Config{})
+	c := dial(t, url)
+	sendMsg(t, c, "hello", HelloReq{Name: "a", Version: ProtocolVersion, Caps: []string{EncodingBinaryV1}})
+	var ack HelloAck
+	if err := json.Unmarshal(readMsg(t, c, "hello_ack"), &ack); err != nil || ack.Encoding != EncodingBinaryV1 {
+		t.Fatalf("hello_ack = %+v, %v", ack, err)
+	}
+
+	// without the limiter the server never closes; fail instead of hanging
+	c.SetIdleTimeout(5 * time.Second)
+	// an input frame too short to decode
+	bad := []byte{binaryVersion1, binKindInput}
+	for i := 0; i < 100; i++ {
+		if err := c.WriteBinary(bad); err != nil {
+			break
+		}
+	}
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			if code := ws.CloseCode(err); code != closeFlood {
+				t.Fatalf("closed with %d (%v), want %d", code, err, closeFlood)
+			}
+			return
+		}
+	}
+}
+
+func TestAFKKickClosesConnection(t *testing.T) {
+	_, url := startHub(t, Config{
+		Tick:           10 * time.Millisecond,
+		AFKTimeout:     50 * time.Millisecond,
+		AFKKickTimeout: 50 * time.Millisecond,
+	})
+	c := dial(t, url)
+	c.SetIdleTimeout(5 * time.Second)
+	sendMsg(t, c, "hello", HelloReq{Name: "a", Version: ProtocolVersion})
+	readMsg(t, c, "hello_ack")
+	sendMsg(t, c, "room_create", RoomCreateReq{Name: "afk"})
+	readMsg(t, c, "room_state")
+	sendMsg(t, c, "room_ready", RoomReadyReq{Ready: true})
+	sendMsg(t, c, "room_start", RoomStartReq{})
+	readMsg(t, c, "game_start")
+
+	// send nothing: the player goes AFK, is removed and then dropped
+	var kicked RoomKickedMsg
+	if err := json.Unmarshal(readMsg(t, c, "room_kicked"), &kicked); err != nil || kicked.Reason != kickAFK {
+		t.Fatalf("room_kicked = %+v, %v", kicked, err)
+	}
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			if code := ws.CloseCode(err); code != closeKicked {
+				t.Fatalf("closed with %d (%v), want %d", code, err, closeKicked)
+			}
+			return
+		}
+	}
+}
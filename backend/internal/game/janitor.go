@@ -0,0 +1,35 @@
+package game
+
+import (
+	"log"
+	"time"
+)
+
+// janitor closes lobby rooms nobody has used for Config.RoomIdleTimeout.
+// AFK players are handled by the room loops themselves, see checkAFK.
+func (h *Hub) janitor() {
+	t := time.NewTicker(min(h.cfg.RoomIdleTimeout/4, time.Minute))
+	defer t.Stop()
+	for now := range t.C {
+		if h.Draining() {
+			return
+		}
+		now := now
+		for _, room := range h.allRooms() {
+			room := room
+			_ = room.do(func() {
+				room.expireIdle(now, h.cfg.RoomIdleTimeout)
+			})
+		}
+	}
+}
+
+// expireIdle closes the room if it sits in the lobby and nothing has
+// happened in it for idle.
+func (r *Room) expireIdle(now time.Time, idle time.Duration) {
+	if r.closed || r.started || now.Sub(r.lastActive) < idle {
+		return
+	}
+	log.Printf("room %s: idle in the lobby for %v, closing", r.id, idle)
+	r.close()
+}
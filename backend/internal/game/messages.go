@@ -3,17 +3,48 @@ package game
 import "encoding/json"
 
 type Envelope struct {
-	Type    string          `json:"type"`
+	Type string `json:"type"`
+	// ID is an optional client-chosen request id. Direct replies to the
+	// request (including errors) carry the same id.
+	ID      string          `json:"id,omitempty"`
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 type HelloReq struct {
 	Name string `json:"name"`
+	// Version is the newest protocol version the client speaks and
+	// MinVersion the oldest it can fall back to; see ProtocolVersion.
+	// Version 1 clients send neither.
+	Version    int `json:"version,omitempty"`
+	MinVersion int `json:"minVersion,omitempty"`
+	// Caps lists the optional features the client wants, see CapResume.
+	Caps []string `json:"caps,omitempty"`
+	// Encodings is the version 1 form of Caps: the hot-path encodings the
+	// client understands. JSON is always available.
+	Encodings []string `json:"encodings,omitempty"`
 }
 
 type HelloAck struct {
 	UserID string `json:"userId"`
 	Name   string `json:"name"`
+	// Version is the negotiated protocol version and Caps everything the
+	// server supports; a feature is on if both sides listed it.
+	Version  int      `json:"version"`
+	Caps     []string `json:"caps"`
+	Encoding string   `json:"encoding"`
+	// ResumeToken lets a new connection take over this user (and its room
+	// slot) with a resume message after the socket drops.
+	ResumeToken string `json:"resumeToken"`
+}
+
+// ResumeReq is sent instead of hello to reattach to a previous session.
+// The protocol is negotiated again, as for hello.
+type ResumeReq struct {
+	Token      string   `json:"token"`
+	Version    int      `json:"version,omitempty"`
+	MinVersion int      `json:"minVersion,omitempty"`
+	Caps       []string `json:"caps,omitempty"`
+	Encodings  []string `json:"encodings,omitempty"`
 }
 
 type RoomsMsg struct {
@@ -22,10 +53,17 @@ type RoomsMsg struct {
 
 type RoomCreateReq struct {
 	Name string `json:"name"`
+	// MaxPlayers is the number of player slots, 0 for the default
+	MaxPlayers int    `json:"maxPlayers,omitempty"`
+	Private    bool   `json:"private,omitempty"`
+	Password   string `json:"password,omitempty"`
 }
 
 type RoomJoinReq struct {
 	RoomID string `json:"roomId"`
+	// Spectate joins as a spectator instead of a player
+	Spectate bool   `json:"spectate,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 type RoomReadyReq struct {
@@ -36,25 +74,65 @@ type RoomStartReq struct {
 	WinScore         *int    `json:"winScore,omitempty"`
 	ShowEnemiesOnMap *bool   `json:"showEnemiesOnMap,omitempty"`
 	WallText         *string `json:"wallText,omitempty"`
+	AllowLateJoin    *bool   `json:"allowLateJoin,omitempty"`
+	AllowSpectators  *bool   `json:"allowSpectators,omitempty"`
 }
 
 type RoomConfigReq struct {
 	WinScore         *int    `json:"winScore,omitempty"`
 	ShowEnemiesOnMap *bool   `json:"showEnemiesOnMap,omitempty"`
 	WallText         *string `json:"wallText,omitempty"`
+	AllowLateJoin    *bool   `json:"allowLateJoin,omitempty"`
+	AllowSpectators  *bool   `json:"allowSpectators,omitempty"`
+	MaxPlayers       *int    `json:"maxPlayers,omitempty"`
+	Private          *bool   `json:"private,omitempty"`
+	Password         *string `json:"password,omitempty"`
+}
+
+// RoomTargetReq names the user a host moderation message (room_kick,
+// room_ban, room_transfer_host) applies to.
+type RoomTargetReq struct {
+	UserID string `json:"userId"`
+}
+
+// RoomKickedMsg tells a client the host removed it from the room.
+type RoomKickedMsg struct {
+	RoomID string `json:"roomId"`
+	// Banned is set if the client may not join the room again
+	Banned bool `json:"banned"`
+	// Reason is "afk" when the server removed an idle player
+	Reason string `json:"reason,omitempty"`
+}
+
+// RoomClosedMsg tells whoever is still in a room that it is gone: the last
+// player left, or it sat idle in the lobby for Config.RoomIdleTimeout.
+type RoomClosedMsg struct {
+	RoomID string `json:"roomId"`
 }
 
 type ErrorMsg struct {
+	// Code is a stable machine-readable reason, see errors.go
+	Code    string `json:"code"`
 	Message string `json:"message"`
+	// Type echoes the offending message type, e.g. for "unknown type"
+	Type string `json:"type,omitempty"`
 }
 
 type InputReq struct {
-	Forward bool    `json:"forward"`
-	Back    bool    `json:"back"`
-	Left    bool    `json:"left"`
-	Right   bool    `json:"right"`
-	Turn    float64 `json:"turn"`
-	Shoot   bool    `json:"shoot"`
+	// Seq numbers a client's inputs, starting at 1; it comes back as
+	// PlayerFrame.Ack once the input has been applied. 0 means the client
+	// does not track its inputs.
+	Seq uint32 `json:"seq,omitempty"`
+	// ViewTick is the game_state tick the client showed when it shot; the
+	// server tests the shot against where the players were then, see
+	// Config.MaxRewind. 0 tests against the current positions.
+	ViewTick uint64  `json:"viewTick,omitempty"`
+	Forward  bool    `json:"forward"`
+	Back     bool    `json:"back"`
+	Left     bool    `json:"left"`
+	Right    bool    `json:"right"`
+	Turn     float64 `json:"turn"`
+	Shoot    bool    `json:"shoot"`
 }
 
 type GameStartMsg struct {
@@ -90,4 +168,41 @@ type GameOverMsg struct {
 	WinnerID string        `json:"winnerId"`
 	WinScore int           `json:"winScore"`
 	Rankings []PlayerFrame `json:"rankings"`
+	// Reason is set when the match ended before anyone reached WinScore.
+	Reason string `json:"reason,omitempty"`
+	// ReturnAt (unix ms) is when the room goes back to the lobby unless a
+	// player sends room_rematch first.
+	ReturnAt int64 `json:"returnAt"`
+	// RecordingID names the saved recording of the match, if
+	// Config.RecordDir is set; see cmd/replay.
+	RecordingID string `json:"recordingId,omitempty"`
+}
+
+// ServerShutdownMsg announces a restart. Running matches may finish until
+// Deadline (unix ms); after that they end with the current rankings.
+type ServerShutdownMsg struct {
+	Deadline int64  `json:"deadline"`
+	Reason   string `json:"reason"`
+}
+
+// ReplayControlReq (replay_control) steers a replay stream from
+// cmd/replay. Unset fields are left as they are; Seek jumps to a tick,
+// backwards as well.
+type ReplayControlReq struct {
+	Speed  *float64 `json:"speed,omitempty"`
+	Paused *bool    `json:"paused,omitempty"`
+	Seek   *uint64  `json:"seek,omitempty"`
+}
+
+// ReplayInfoMsg (replay_info) describes a replay stream. It is sent when
+// the stream starts and after every replay_control.
+type ReplayInfoMsg struct {
+	RecordingID string `json:"recordingId"`
+	RoomName    string `json:"roomName"`
+	// StartedAt (unix ms) is when the match was played
+	StartedAt int64   `json:"startedAt"`
+	Ticks     uint64  `json:"ticks"`
+	Tick      uint64  `json:"tick"`
+	Speed     float64 `json:"speed"`
+	Paused    bool    `json:"paused"`
 }
@@ -0,0 +1,70 @@
+package game
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ProtocolVersion is the newest message protocol the server speaks. A
+// client announces its own newest version in hello (or resume) and both
+// sides use the lower of the two.
+//
+// Version 1 is the original protocol, whose hello has no version field and
+// lists hot-path encodings instead of capabilities. It is still accepted.
+const (
+	ProtocolVersion    = 2
+	minProtocolVersion = 1
+)
+
+// Capabilities are optional protocol features. A feature is used on a
+// connection only if the client listed it and the server supports it.
+const (
+	// CapBinaryV1 sends input and game_state as binary frames, see
+	// binary.go.
+	CapBinaryV1 = EncodingBinaryV1
+	// CapResume lets a dropped client take its session back with resume.
+	CapResume = "resume"
+	// CapDeltaV1 sends game_state as deltas against acked snapshots, see
+	// delta.go. It works with either encoding.
+	CapDeltaV1 = "delta.v1"
+)
+
+// serverCaps is what the server offers, returned in hello_ack.
+var serverCaps = []string{CapBinaryV1, CapResume, CapDeltaV1}
+
+// negotiateProtocol picks the protocol version and the capabilities enabled for a
+// client that speaks versions minVersion..version and asked for caps.
+// legacy carries the version 1 encodings list.
+func negotiateProtocol(version, minVersion int, caps, legacy []string) (int, []string, *Error) {
+	if version == 0 {
+		version = 1
+	}
+	if minVersion == 0 || minVersion > version {
+		minVersion = version
+	}
+	v := min(version, ProtocolVersion)
+	if v < minProtocolVersion || v < minVersion {
+		return 0, nil, &Error{
+			Code: codeUnsupportedVersion,
+			Message: fmt.Sprintf("unsupported protocol version %d (min %d), server speaks %d-%d",
+				version, minVersion, minProtocolVersion, ProtocolVersion),
+		}
+	}
+	if v == 1 {
+		// version 1 hello named encodings, which are capabilities now;
+		// resume came with the same clients
+		caps = append(slices.Clone(legacy), CapResume)
+	}
+	var enabled []string
+	for _, c := range serverCaps {
+		if slices.Contains(caps, c) {
+			enabled = append(enabled, c)
+		}
+	}
+	return v, enabled, nil
+}
+
+// has reports whether capability name was negotiated for c.
+func (c *Client) has(name string) bool {
+	return slices.Contains(c.caps, name)
+}
@@ -0,0 +1,183 @@
+package game
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowHardFactor times Config.SendQueue is the backlog at which a client is
+// dropped at once, without waiting out SlowConsumerTimeout.
+const slowHardFactor = 8
+
+// sendQueue is a client's outbound queue, drained by its write loop.
+//
+// Reliable messages are never dropped. Snapshots (game_state, the lobby
+// room list) are full replacements of what came before, so only the newest
+// of each kind is kept: pushing one replaces a snapshot of the same kind
+// that is still queued. A client that cannot keep up is disconnected
+// instead of silently losing messages, see Hub.enqueue.
+type sendQueue struct {
+	mu   sync.Mutex
+	msgs []outMsg
+	// snapshots maps a snapshot kind to its index in msgs
+	snapshots map[string]int
+	// backedUp is when the backlog last went over the limit; zero while
+	// the client keeps up
+	backedUp time.Time
+	closed   bool
+
+	// ready has a token whenever msgs is non-empty
+	ready chan struct{}
+
+	// coalesced counts snapshots replaced before being written
+	coalesced atomic.Uint64
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{snapshots: map[string]int{}, ready: make(chan struct{}, 1)}
+}
+
+// push queues m; kind is empty for reliable messages. It reports whether
+// a queued snapshot was replaced, the backlog length, and for how long the
+// backlog has been above limit.
+func (q *sendQueue) push(m outMsg, kind string, limit int) (coalesced bool, n int, over time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, 0, 0
+	}
+	if kind != "" {
+		if i, ok := q.snapshots[kind]; ok {
+			q.msgs = slices.Delete(q.msgs, i, i+1)
+			q.shift(i)
+			q.coalesced.Add(1)
+			coalesced = true
+		}
+		q.snapshots[kind] = len(q.msgs)
+	}
+	q.msgs = append(q.msgs, m)
+	q.signal()
+
+	n = len(q.msgs)
+	if n <= limit {
+		q.backedUp = time.Time{}
+		return coalesced, n, 0
+	}
+	now := time.Now()
+	if q.backedUp.IsZero() {
+		q.backedUp = now
+	}
+	return coalesced, n, now.Sub(q.backedUp)
+}
+
+// pop takes the oldest message.
+func (q *sendQueue) pop() (outMsg, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.msgs) == 0 {
+		return outMsg{}, false
+	}
+	m := q.msgs[0]
+	q.msgs[0] = outMsg{}
+	q.msgs = q.msgs[1:]
+	q.shift(0)
+	if len(q.msgs) > 0 {
+		q.signal()
+	} else {
+		q.msgs = nil
+	}
+	return m, true
+}
+
+// discard empties the queue and refuses further messages. It reports
+// false if the queue was already discarded.
+func (q *sendQueue) discard() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, false
+	}
+	n := len(q.msgs)
+	q.msgs = nil
+	clear(q.snapshots)
+	q.closed = true
+	return n, true
+}
+
+// shift updates snapshot indexes after msgs[i] was removed.
+func (q *sendQueue) shift(i int) {
+	for kind, j := range q.snapshots {
+		switch {
+		case j == i:
+			delete(q.snapshots, kind)
+		case j > i:
+			q.snapshots[kind] = j - 1
+		}
+	}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Stats are totals over the hub's lifetime.
+type Stats struct {
+	// Coalesced is the number of snapshots (game_state, rooms) replaced by
+	// a newer one before they were written.
+	Coalesced uint64
+	// Dropped is the number of queued messages discarded when slow
+	// consumers were disconnected.
+	Dropped uint64
+	// SlowConsumers is the number of clients disconnected for not keeping
+	// up with their send queue.
+	SlowConsumers uint64
+	// RateLimited is the number of client messages dropped by
+	// Config.RateLimits.
+	RateLimited uint64
+}
+
+type hubStats struct {
+	coalesced     atomic.Uint64
+	dropped       atomic.Uint64
+	slowConsumers atomic.Uint64
+	rateLimited   atomic.Uint64
+}
+
+func (h *Hub) Stats() Stats {
+	return Stats{
+		Coalesced:     h.stats.coalesced.Load(),
+		Dropped:       h.stats.dropped.Load(),
+		SlowConsumers: h.stats.slowConsumers.Load(),
+		RateLimited:   h.stats.rateLimited.Load(),
+	}
+}
+
+// enqueue queues msg for c. A non-empty kind marks a snapshot that a newer
+// one of the same kind may replace. A client whose backlog stays above cfg.SendQueue
+// for cfg.SlowConsumerTimeout, or reaches slowHardFactor times it, is
+// disconnected.
+func (h *Hub) enqueue(c *Client, msg outMsg, kind string) {
+	coalesced, n, over := c.queue.push(msg, kind, h.cfg.SendQueue)
+	if coalesced {
+		h.stats.coalesced.Add(1)
+	}
+	if over < h.cfg.SlowConsumerTimeout && n < slowHardFactor*h.cfg.SendQueue {
+		return
+	}
+
+	dropped, ok := c.queue.discard()
+	if !ok {
+		return
+	}
+	h.stats.dropped.Add(uint64(dropped))
+	h.stats.slowConsumers.Add(1)
+	log.Printf("client %s: slow consumer, %d messages queued for %v, %d snapshots coalesced; disconnecting",
+		c.id, dropped, over.Round(time.Millisecond), c.queue.coalesced.Load())
+	h.closeClient(c, closeSlow, "too slow")
+}
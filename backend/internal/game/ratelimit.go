@@ -0,0 +1,207 @@
+package game
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RateLimit is a token bucket: a client may send Burst messages of a type
+// at once and then Rate per second. The zero value means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// DefaultRateLimits are the per-client limits used for types that
+// Config.RateLimits does not list. "*" applies to every type without an
+// entry of its own; input and state_ack default to twice the tick rate, see
+// Config.withDefaults.
+var DefaultRateLimits = map[string]RateLimit{
+	"*":           {Rate: 10, Burst: 20},
+	"room_create": {Rate: 0.2, Burst: 3},
+	"room_join":   {Rate: 1, Burst: 5},
+	"rooms_list":  {Rate: 2, Burst: 5},
+	"chat_send":   {Rate: 1, Burst: 5},
+	"ping":        {Rate: 2, Burst: 5},
+}
+
+// A client collects a strike for every message dropped by its limits and
+// loses one per second. Enough strikes first mute its chat, then
+// disconnect it.
+const (
+	muteStrikes  = 10
+	kickStrikes  = 30
+	muteDuration = 30 * time.Second
+)
+
+// bucket is one token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(l RateLimit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(l.Burst)
+	} else {
+		b.tokens = min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// flood is a client's rate limiting state. It is only touched by the
+// client's read loop.
+type flood struct {
+	buckets    map[string]*bucket
+	strikes    float64
+	struckAt   time.Time
+	mutedUntil time.Time
+}
+
+// strike adds a strike and returns the total after decay.
+func (f *flood) strike(now time.Time) float64 {
+	if !f.struckAt.IsZero() {
+		f.strikes = max(0, f.strikes-now.Sub(f.struckAt).Seconds())
+	}
+	f.struckAt = now
+	f.strikes++
+	return f.strikes
+}
+
+func (f *flood) muted(now time.Time) bool {
+	return now.Before(f.mutedUntil)
+}
+
+// limit returns the limit for message type typ and the bucket it draws
+// from. Types without a route share one bucket, so made up types cannot
+// grow the map.
+func (h *Hub) limit(typ string) (string, RateLimit) {
+	if _, ok := h.routes[typ]; !ok {
+		typ = "*"
+	}
+	if l, ok := h.cfg.RateLimits[typ]; ok {
+		return typ, l
+	}
+	return typ, h.cfg.RateLimits["*"]
+}
+
+// allow charges one message of type typ to c's bucket. A message over the
+// limit earns a strike; allow then escalates and reports whether the
+// caller should still answer with an error.
+func (h *Hub) allow(c *Client, typ string) (ok, reply bool) {
+	select {
+	case <-c.closing:
+		// already on its way out, e.g. disconnected for flooding
+		return false, false
+	default:
+	}
+	key, l := h.limit(typ)
+	if l == (RateLimit{}) {
+		return true, false
+	}
+	f := &c.flood
+	if f.buckets == nil {
+		f.buckets = map[string]*bucket{}
+	}
+	b := f.buckets[key]
+	if b == nil {
+		b = &bucket{}
+		f.buckets[key] = b
+	}
+	now := time.Now()
+	if b.take(l, now) {
+		return true, false
+	}
+
+	h.stats.rateLimited.Add(1)
+	strikes := f.strike(now)
+	switch {
+	case strikes >= kickStrikes:
+		log.Printf("client %s: flooding %q, disconnecting", c.id, typ)
+		h.closeClient(c, closeFlood, "rate limit exceeded")
+		return false, false
+	case strikes >= muteStrikes && !f.muted(now):
+		log.Printf("client %s: flooding %q, muted for %v", c.id, typ, muteDuration)
+		f.mutedUntil = now.Add(muteDuration)
+		return false, true
+	case f.muted(now):
+		// a muted client has been told; stop answering it
+		return false, false
+	}
+	return false, true
+}
+
+// rateLimit is the middleware enforcing Config.RateLimits and chat mutes.
+func (h *Hub) rateLimit(next HandlerFunc) HandlerFunc {
+	return func(c *Client, m *Message) {
+		ok, reply := h.allow(c, m.Type)
+		if !ok {
+			if reply && h.routes[m.Type].flags&quiet == 0 {
+				err := errRateLimited
+				if c.flood.muted(time.Now()) {
+					err = errMuted
+				}
+				h.sendError(c, m.ID, err)
+			}
+			return
+		}
+		if m.Type == "chat_send" && c.flood.muted(time.Now()) {
+			h.sendError(c, m.ID, errMuted)
+			return
+		}
+		next(c, m)
+	}
+}
+
+// rejectFrame answers a frame that never reached a handler, e.g. invalid
+// JSON. Such frames are charged to the "*" bucket, so they cannot be used
+// to get around the limits.
+func (h *Hub) rejectFrame(c *Client, err *Error) {
+	if ok, reply := h.allow(c, ""); ok || reply {
+		h.sendError(c, "", err)
+	}
+}
+
+// acquireConn counts a connection from ip against Config.MaxConnsPerIP
+// and reports whether it may proceed. Every successful call must be paired
+// with releaseConn.
+func (h *Hub) acquireConn(ip string) bool {
+	if h.cfg.MaxConnsPerIP < 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[ip] >= h.cfg.MaxConnsPerIP {
+		return false
+	}
+	h.conns[ip]++
+	return true
+}
+
+func (h *Hub) releaseConn(ip string) {
+	if h.cfg.MaxConnsPerIP < 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[ip]--; h.conns[ip] <= 0 {
+		delete(h.conns, ip)
+	}
+}
+
+// remoteIP is the address of the TCP peer. Behind a reverse proxy that is
+// the proxy, so the per-IP cap should then be disabled or enforced there.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,447 @@
+package game
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Match recordings. With Config.RecordDir set, every match that reaches
+// game_over is saved as <RecordDir>/<recording id>.rec. Since the
+// Simulation is deterministic, a recording only holds what went into it:
+// the game_start parameters and seed, who joined and left, and the inputs
+// applied each tick. Replay re-simulates it.
+//
+// The file is gzip compressed:
+//
+//	"FPSR" | version u8 | header length u32 | header (RecordingHeader as JSON)
+//	records until EOF, each kind u8 followed by
+//	  join  : idLen u8 | id | nameLen u8 | name
+//	  leave : slot uvarint
+//	  tick  : count uvarint | count × (slot uvarint | flags u8 | [turn f64] | [viewTick uvarint])
+//	  end   : idLen u8 | winner id | len u8 | reason
+//
+// Joined players get the next slot number, starting at 0. A tick record
+// lists the players that had an input that tick; flags are the binary
+// input flags plus recTurn and recViewTick for the optional fields.
+// Integers are little endian; turn is the exact float64.
+
+const recordingVersion = 1
+
+var recordingMagic = []byte("FPSR")
+
+const (
+	recJoin  byte = 1
+	recLeave byte = 2
+	recTick  byte = 3
+	recEnd   byte = 4
+)
+
+const (
+	recTurn byte = 1 << (iota + 5)
+	recViewTick
+)
+
+var (
+	errBadRecording = errors.New("malformed recording")
+	validRecording  = regexp.MustCompile(`^rec_[a-z0-9]+$`)
+)
+
+type RecordingHeader struct {
+	Version  int    `json:"version"`
+	ID       string `json:"id"`
+	RoomID   string `json:"roomId"`
+	RoomName string `json:"roomName"`
+	// StartedAt is unix ms
+	StartedAt int64  `json:"startedAt"`
+	Seed      int64  `json:"seed"`
+	MaxRewind uint64 `json:"maxRewind"`
+	// Game is the game_start the players got
+	Game GameStartMsg `json:"game"`
+}
+
+// recorder collects a running match; see Room.startRecording.
+type recorder struct {
+	header RecordingHeader
+	buf    []byte
+	// ids maps slots to players, "" once they left
+	ids   []string
+	slots map[string]int
+}
+
+func newRecorder(h RecordingHeader) *recorder {
+	return &recorder{header: h, slots: map[string]int{}}
+}
+
+func (rec *recorder) join(id, name string) {
+	rec.slots[id] = len(rec.ids)
+	rec.ids = append(rec.ids, id)
+	rec.buf = append(rec.buf, recJoin)
+	rec.buf = appendID(rec.buf, id)
+	rec.buf = appendID(rec.buf, name)
+}
+
+func (rec *recorder) leave(id string) {
+	slot, ok := rec.slots[id]
+	if !ok {
+		return
+	}
+	delete(rec.slots, id)
+	rec.ids[slot] = ""
+	rec.buf = append(rec.buf, recLeave)
+	rec.buf = binary.AppendUvarint(rec.buf, uint64(slot))
+}
+
+// tick records the inputs given to one Simulation.Step.
+func (rec *recorder) tick(inputs map[string]InputReq) {
+	n := 0
+	for _, id := range rec.ids {
+		if _, ok := inputs[id]; ok && id != "" {
+			n++
+		}
+	}
+	rec.buf = append(rec.buf, recTick)
+	rec.buf = binary.AppendUvarint(rec.buf, uint64(n))
+	for slot, id := range rec.ids {
+		in, ok := inputs[id]
+		if id == "" || !ok {
+			continue
+		}
+		flags := inputFlags(in)
+		if in.Turn != 0 {
+			flags |= recTurn
+		}
+		if in.ViewTick != 0 {
+			flags |= recViewTick
+		}
+		rec.buf = binary.AppendUvarint(rec.buf, uint64(slot))
+		rec.buf = append(rec.buf, flags)
+		if in.Turn != 0 {
+			rec.buf = binary.LittleEndian.AppendUint64(rec.buf, math.Float64bits(in.Turn))
+		}
+		if in.ViewTick != 0 {
+			rec.buf = binary.AppendUvarint(rec.buf, in.ViewTick)
+		}
+	}
+}
+
+func (rec *recorder) end(winnerID, reason string) {
+	rec.buf = append(rec.buf, recEnd)
+	rec.buf = appendID(rec.buf, winnerID)
+	rec.buf = appendID(rec.buf, reason)
+}
+
+// save writes the recording to dir. The file only appears once complete.
+func (rec *recorder) save(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	header, err := json.Marshal(rec.header)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, rec.header.ID+".rec")
+	f, err := os.CreateTemp(dir, rec.header.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	zw := gzip.NewWriter(f)
+	b := append([]byte{}, recordingMagic...)
+	b = append(b, recordingVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(header)))
+	b = append(b, header...)
+	_, err = zw.Write(b)
+	if err == nil {
+		_, err = zw.Write(rec.buf)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// startRecording begins recording the match Start just set up.
+func (r *Room) startRecording(gs GameStartMsg) {
+	r.rec = newRecorder(RecordingHeader{
+		Version:   recordingVersion,
+		ID:        newID("rec_"),
+		RoomID:    r.id,
+		RoomName:  r.name,
+		StartedAt: time.Now().UnixMilli(),
+		Seed:      r.sim.Seed(),
+		MaxRewind: r.maxRewind,
+		Game:      gs,
+	})
+	for _, p := range r.sim.Frames() {
+		r.rec.join(p.ID, r.players[p.ID].name)
+	}
+}
+
+// saveRecording ends the recording and saves it to Config.RecordDir. It
+// returns the recording id, "" if the match was not recorded.
+func (r *Room) saveRecording() string {
+	rec := r.rec
+	if rec == nil {
+		return ""
+	}
+	r.rec = nil
+	rec.end(r.winnerID, r.endReason)
+	if err := rec.save(r.hub.cfg.RecordDir); err != nil {
+		log.Printf("room %s: saving recording: %v", r.id, err)
+		return ""
+	}
+	return rec.header.ID
+}
+
+// Recording is a parsed recording file.
+type Recording struct {
+	RecordingHeader
+	// WinnerID and Reason are as in game_over
+	WinnerID string
+	Reason   string
+
+	steps []recStep
+	// names of everyone who played
+	names map[string]string
+}
+
+// recStep is one Simulation.Step and the joins and leaves before it.
+type recStep struct {
+	changes []recChange
+	inputs  map[string]InputReq
+}
+
+type recChange struct {
+	id    string
+	leave bool
+}
+
+// Ticks is the length of the recorded match.
+func (rec *Recording) Ticks() uint64 { return uint64(len(rec.steps)) }
+
+// Names maps the ids of everyone who played to their names.
+func (rec *Recording) Names() map[string]string { return rec.names }
+
+// ValidRecordingID reports whether id can name a recording file; ids come
+// from clients, so check them before building a path.
+func ValidRecordingID(id string) bool {
+	return validRecording.MatchString(id)
+}
+
+// OpenRecording reads the recording id from dir.
+func OpenRecording(dir, id string) (*Recording, error) {
+	if !ValidRecordingID(id) {
+		return nil, fmt.Errorf("bad recording id %q", id)
+	}
+	f, err := os.Open(filepath.Join(dir, id+".rec"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+func ReadRecording(r io.Reader) (*Recording, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(bufio.NewReader(zr))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 9 || !bytes.Equal(data[:4], recordingMagic) {
+		return nil, errBadRecording
+	}
+	if data[4] != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", data[4])
+	}
+	n := int(binary.LittleEndian.Uint32(data[5:]))
+	data = data[9:]
+	if len(data) < n {
+		return nil, errBadRecording
+	}
+	rec := &Recording{names: map[string]string{}}
+	if err := json.Unmarshal(data[:n], &rec.RecordingHeader); err != nil {
+		return nil, err
+	}
+	if err := rec.parse(data[n:]); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *Recording) parse(b []byte) error {
+	var (
+		ids     []string
+		changes []recChange
+		ok      bool
+	)
+	slot := func() (string, bool) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 || v >= uint64(len(ids)) {
+			return "", false
+		}
+		b = b[n:]
+		return ids[v], true
+	}
+	for len(b) > 0 {
+		kind := b[0]
+		b = b[1:]
+		switch kind {
+		case recJoin:
+			var id, name string
+			if id, b, ok = readID(b); !ok {
+				return errBadRecording
+			}
+			if name, b, ok = readID(b); !ok {
+				return errBadRecording
+			}
+			ids = append(ids, id)
+			rec.names[id] = name
+			changes = append(changes, recChange{id: id})
+		case recLeave:
+			id, ok := slot()
+			if !ok {
+				return errBadRecording
+			}
+			changes = append(changes, recChange{id: id, leave: true})
+		case recTick:
+			count, n := binary.Uvarint(b)
+			if n <= 0 || count > uint64(len(ids)) {
+				return errBadRecording
+			}
+			b = b[n:]
+			step := recStep{changes: changes, inputs: make(map[string]InputReq, count)}
+			changes = nil
+			for i := uint64(0); i < count; i++ {
+				id, ok := slot()
+				if !ok || len(b) < 1 {
+					return errBadRecording
+				}
+				flags := b[0]
+				b = b[1:]
+				in := inputFromFlags(flags)
+				if flags&recTurn != 0 {
+					if len(b) < 8 {
+						return errBadRecording
+					}
+					in.Turn = math.Float64frombits(binary.LittleEndian.Uint64(b))
+					b = b[8:]
+				}
+				if flags&recViewTick != 0 {
+					v, n := binary.Uvarint(b)
+					if n <= 0 {
+						return errBadRecording
+					}
+					in.ViewTick = v
+					b = b[n:]
+				}
+				step.inputs[id] = in
+			}
+			rec.steps = append(rec.steps, step)
+		case recEnd:
+			if rec.WinnerID, b, ok = readID(b); !ok {
+				return errBadRecording
+			}
+			if rec.Reason, b, ok = readID(b); !ok {
+				return errBadRecording
+			}
+		default:
+			return errBadRecording
+		}
+	}
+	return nil
+}
+
+// Replay re-simulates a Recording. Seek makes any tick reachable, going
+// back by simulating again from the start.
+type Replay struct {
+	rec *Recording
+	sim *Simulation
+	// next is the index of the next recStep
+	next int
+}
+
+func NewReplay(rec *Recording) *Replay {
+	p := &Replay{rec: rec}
+	p.reset()
+	return p
+}
+
+func (p *Replay) reset() {
+	p.sim = NewSimulation(p.rec.Game.Map, p.rec.Seed)
+	p.sim.SetMaxRewind(p.rec.MaxRewind)
+	p.next = 0
+}
+
+func (p *Replay) Recording() *Recording { return p.rec }
+func (p *Replay) Tick() uint64          { return p.sim.Tick() }
+func (p *Replay) Done() bool            { return p.next >= len(p.rec.steps) }
+
+// Score is id's kills at the current tick.
+func (p *Replay) Score(id string) int { return p.sim.Score(id) }
+
+// Step plays the next tick. It returns false at the end of the match.
+func (p *Replay) Step() (Events, bool) {
+	if p.Done() {
+		return Events{}, false
+	}
+	step := p.rec.steps[p.next]
+	p.next++
+	for _, c := range step.changes {
+		if c.leave {
+			p.sim.RemovePlayer(c.id)
+		} else {
+			p.sim.AddPlayer(c.id)
+		}
+	}
+	return p.sim.Step(step.inputs), true
+}
+
+// Seek moves to tick, or the end of the match if it is shorter.
+func (p *Replay) Seek(tick uint64) {
+	if tick < p.sim.Tick() {
+		p.reset()
+	}
+	for p.sim.Tick() < tick {
+		if _, ok := p.Step(); !ok {
+			return
+		}
+	}
+}
+
+// GameState is the game_state of the current tick.
+func (p *Replay) GameState() GameState {
+	out := GameState{Tick: p.sim.Tick(), Players: p.sim.Frames()}
+	for i := range out.Players {
+		out.Players[i].Name = p.rec.names[out.Players[i].ID]
+	}
+	return out
+}
+
+// Rankings are the players at the current tick, best first.
+func (p *Replay) Rankings() []PlayerFrame {
+	out := p.GameState().Players
+	sortRankings(out)
+	return out
+}
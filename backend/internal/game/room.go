@@ -1,11 +1,22 @@
 package game
 
 import (
-	"math"
+	"crypto/subtle"
+	"math/rand"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Room sizes a host can pick; spectators do not count.
+const (
+	minRoomPlayers     = 2
+	maxRoomPlayers     = 16
+	defaultRoomPlayers = 8
+	maxPasswordLen     = 32
+)
+
 type Room struct {
 	id     string
 	name   string
@@ -17,13 +28,55 @@ type Room struct {
 	finished     bool
 	gameOverSent bool
 	winnerID     string
+	// endReason explains an early finish, e.g. a server shutdown
+	endReason    string
 	winScore     int
 	showEnemiesOnMap bool
 	wallText string
-	tick    uint64
+	// allowLateJoin lets players join a running match, allowSpectators
+	// lets anyone watch
+	allowLateJoin   bool
+	allowSpectators bool
+	// maxPlayers caps the players; private rooms are left out of the
+	// lobby listing and joined by id; a non-empty password is required
+	// by room_join
+	maxPlayers int
+	private    bool
+	password   string
 	m       Map
+	// sim is the current or last match; nil before the first Start
+	sim *Simulation
+	// maxRewind is passed on to every match, see Simulation.SetMaxRewind
+	maxRewind uint64
 
 	players map[string]*Player
+	// spectators maps user ids to names; they get the match broadcasts
+	// but are not players
+	spectators map[string]string
+	// banned user ids may not join again while the room exists
+	banned map[string]bool
+
+	// hits landed during the last Tick
+	hits []Hit
+	// rec records the running match, see recording.go
+	rec *recorder
+
+	// room goroutine plumbing, see room_loop.go
+	hub     *Hub
+	inbox   chan func()
+	done    chan struct{}
+	closed  bool
+	members map[string]*Client
+	// snapshots are the recent game states, deltas what the members acked
+	// of them; see delta.go
+	snapshots []GameState
+	deltas    map[string]*deltaState
+	summary atomic.Pointer[RoomSummary]
+	// lobbyTimer sends a finished room back to the lobby
+	lobbyTimer *time.Timer
+	// lastActive is when anything was last broadcast to the room, see
+	// Hub.janitor
+	lastActive time.Time
 }
 
 type RoomSummary struct {
@@ -31,6 +84,15 @@ type RoomSummary struct {
 	Name    string `json:"name"`
 	Players int    `json:"players"`
 	Started bool   `json:"started"`
+
+	Spectators      int  `json:"spectators"`
+	AllowLateJoin   bool `json:"allowLateJoin"`
+	AllowSpectators bool `json:"allowSpectators"`
+	MaxPlayers      int  `json:"maxPlayers"`
+	HasPassword     bool `json:"hasPassword"`
+
+	// private rooms are not listed, see Hub.roomSummaries
+	private bool
 }
 
 type RoomState struct {
@@ -43,7 +105,13 @@ type RoomState struct {
 	WinScore int          `json:"winScore"`
 	ShowEnemiesOnMap bool `json:"showEnemiesOnMap"`
 	WallText string       `json:"wallText"`
+	AllowLateJoin   bool  `json:"allowLateJoin"`
+	AllowSpectators bool  `json:"allowSpectators"`
+	MaxPlayers      int   `json:"maxPlayers"`
+	Private         bool  `json:"private"`
+	HasPassword     bool  `json:"hasPassword"`
 	Players []PlayerState `json:"players"`
+	Spectators []PlayerState `json:"spectators"`
 }
 
 type GameState struct {
@@ -52,19 +120,28 @@ type GameState struct {
 }
 
 type PlayerState struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Ready bool   `json:"ready"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Ready        bool   `json:"ready"`
+	Disconnected bool   `json:"disconnected,omitempty"`
+	// AFK players have sent no input for Config.AFKTimeout
+	AFK bool `json:"afk,omitempty"`
+	// Score is from the last match; it is kept in the lobby for display
+	// and reset when the next match starts
+	Score int `json:"score"`
 }
 
 type PlayerFrame struct {
 	ID    string  `json:"id"`
-	Name  string  `json:"name"`
+	Name  string  `json:"name,omitempty"`
 	X     float64 `json:"x"`
 	Y     float64 `json:"y"`
 	Dir   float64 `json:"dir"`
 	HP    int     `json:"hp"`
 	Score int     `json:"score"`
+	// Ack is the Seq of the last input applied to the player; clients
+	// replay their newer inputs on top of the frame to predict movement
+	Ack uint32 `json:"ack,omitempty"`
 }
 
 type Player struct {
@@ -72,14 +149,16 @@ type Player struct {
 	name string
 
 	ready bool
-
-	x, y     float64
-	dir      float64
-	hp       int
-	score    int
-	cooldown int
-
-	input InputReq
+	// disconnected players keep their slot while waiting for a resume
+	disconnected bool
+
+	// inputs are received but not yet applied, one per tick; ack is the
+	// Seq of the last applied one
+	inputs []InputReq
+	ack    uint32
+	// lastInput is the tick of the last input that did something
+	lastInput uint64
+	afk       bool
 }
 
 func NewRoom(id, name, hostID string) *Room {
@@ -93,6 +172,9 @@ func NewRoom(id, name, hostID string) *Room {
 		showEnemiesOnMap: true,
 		wallText: "",
 		players: map[string]*Player{},
+		spectators: map[string]string{},
+		banned:     map[string]bool{},
+		maxPlayers: defaultRoomPlayers,
 	}
 }
 
@@ -102,6 +184,14 @@ func (r *Room) Summary() RoomSummary {
 		Name:    r.name,
 		Players: len(r.players),
 		Started: r.started,
+
+		Spectators:      len(r.spectators),
+		AllowLateJoin:   r.allowLateJoin,
+		AllowSpectators: r.allowSpectators,
+		MaxPlayers:      r.maxPlayers,
+		HasPassword:     r.password != "",
+
+		private: r.private,
 	}
 }
 
@@ -116,81 +206,114 @@ func (r *Room) State() RoomState {
 		WinScore: r.winScore,
 		ShowEnemiesOnMap: r.showEnemiesOnMap,
 		WallText: r.wallText,
+		AllowLateJoin:   r.allowLateJoin,
+		AllowSpectators: r.allowSpectators,
+		MaxPlayers:      r.maxPlayers,
+		Private:         r.private,
+		HasPassword:     r.password != "",
 		Players: make([]PlayerState, 0, len(r.players)),
+		Spectators: make([]PlayerState, 0, len(r.spectators)),
 	}
 	for _, p := range r.players {
-		out.Players = append(out.Players, PlayerState{ID: p.id, Name: p.name, Ready: p.ready})
+		out.Players = append(out.Players, PlayerState{ID: p.id, Name: p.name, Ready: p.ready, Disconnected: p.disconnected, AFK: p.afk, Score: r.score(p.id)})
+	}
+	for id, name := range r.spectators {
+		out.Spectators = append(out.Spectators, PlayerState{ID: id, Name: name})
 	}
 	return out
 }
 
+// now is the current match tick, 0 before the first match.
+func (r *Room) now() uint64 {
+	if r.sim == nil {
+		return 0
+	}
+	return r.sim.Tick()
+}
+
+// score is id's kills in the current or last match.
+func (r *Room) score(id string) int {
+	if r.sim == nil {
+		return 0
+	}
+	return r.sim.Score(id)
+}
+
 func (r *Room) GameState() GameState {
 	out := GameState{
-		Tick:    r.tick,
-		Players: make([]PlayerFrame, 0, len(r.players)),
+		Tick:    r.sim.Tick(),
+		Players: r.sim.Frames(),
 	}
-	for _, p := range r.players {
-		out.Players = append(out.Players, PlayerFrame{
-			ID:    p.id,
-			Name:  p.name,
-			X:     p.x,
-			Y:     p.y,
-			Dir:   p.dir,
-			HP:    p.hp,
-			Score: p.score,
-		})
+	for i := range out.Players {
+		if p := r.players[out.Players[i].ID]; p != nil {
+			out.Players[i].Name = p.name
+			out.Players[i].Ack = p.ack
+		}
 	}
 	return out
 }
 
 func (r *Room) Rankings() []PlayerFrame {
-	out := make([]PlayerFrame, 0, len(r.players))
-	for _, p := range r.players {
-		out = append(out, PlayerFrame{
-			ID:    p.id,
-			Name:  p.name,
-			X:     p.x,
-			Y:     p.y,
-			Dir:   p.dir,
-			HP:    p.hp,
-			Score: p.score,
-		})
-	}
-	sort.Slice(out, func(i, j int) bool {
+	if r.sim == nil {
+		return []PlayerFrame{}
+	}
+	out := r.sim.Frames()
+	for i := range out {
+		if p := r.players[out[i].ID]; p != nil {
+			out[i].Name = p.name
+		}
+	}
+	sortRankings(out)
+	return out
+}
+
+// sortRankings orders players by kills, then health.
+func sortRankings(out []PlayerFrame) {
+	sort.SliceStable(out, func(i, j int) bool {
 		if out[i].Score != out[j].Score {
 			return out[i].Score > out[j].Score
 		}
 		return out[i].HP > out[j].HP
 	})
-	return out
 }
 
 func (r *Room) AddPlayer(id, name string) {
 	if _, ok := r.players[id]; ok {
 		return
 	}
-	spawns := [][2]float64{
-		{2.5, 2.5},
-		{13.5, 2.5},
-		{2.5, 8.5},
-		{13.5, 8.5},
-	}
-	spawn := spawns[len(r.players)%len(spawns)]
 	r.players[id] = &Player{
-		id:   id,
-		name: name,
-		x:    spawn[0],
-		y:    spawn[1],
-		dir:  0,
-		hp:   100,
+		id:        id,
+		name:      name,
+		lastInput: r.now(),
+	}
+	if r.started {
+		// late joiner
+		r.sim.AddPlayer(id)
+		if r.rec != nil {
+			r.rec.join(id, name)
+		}
 	}
 	if r.hostID == "" {
 		r.hostID = id
 	}
 }
 
+// AddSpectator lets id watch the room. Spectators never play, host or
+// count towards readiness and rankings.
+func (r *Room) AddSpectator(id, name string) {
+	r.spectators[id] = name
+}
+
+// RemovePlayer removes a player or spectator.
 func (r *Room) RemovePlayer(id string) {
 	delete(r.players, id)
+	delete(r.spectators, id)
+	if r.sim != nil {
+		r.sim.RemovePlayer(id)
+	}
+	if r.rec != nil {
+		r.rec.leave(id)
+	}
 	if r.hostID == id {
 		r.hostID = ""
 		for pid := range r.players {
@@ -200,6 +323,52 @@ func (r *Room) RemovePlayer(id string) {
 	}
 }
 
+func (r *Room) HasPlayer(id string) bool {
+	_, ok := r.players[id]
+	return ok
+}
+
+// InRoom reports whether id is a player or spectator of the room.
+func (r *Room) InRoom(id string) bool {
+	_, spectator := r.spectators[id]
+	return r.HasPlayer(id) || spectator
+}
+
+// Ban keeps id out of the room for as long as it exists.
+func (r *Room) Ban(id string) {
+	r.banned[id] = true
+}
+
+func (r *Room) Banned(id string) bool {
+	return r.banned[id]
+}
+
+// CanJoin reports whether a player may join now: in the lobby, or in a
+// running match that allows late joiners.
+func (r *Room) CanJoin() bool {
+	return !r.started || r.allowLateJoin && !r.finished
+}
+
+// Full reports whether the room has no player slot left.
+func (r *Room) Full() bool {
+	return len(r.players) >= r.maxPlayers
+}
+
+// CheckPassword reports whether pw opens the room.
+func (r *Room) CheckPassword(pw string) bool {
+	return subtle.ConstantTimeCompare([]byte(pw), []byte(r.password)) == 1
+}
+
+func (r *Room) SetConnected(id string, connected bool) {
+	if p := r.players[id]; p != nil {
+		p.disconnected = !connected
+		p.inputs = nil
+		p.ack = 0
+		p.lastInput = r.now()
+		p.afk = false
+	}
+}
+
 func (r *Room) SetReady(id string, ready bool) {
 	if p := r.players[id]; p != nil {
 		p.ready = ready
@@ -218,16 +387,66 @@ func (r *Room) AllReady() bool {
 	return true
 }
 
+// Start begins a match with a fresh simulation: every player on a spawn
+// point with full health and no kills.
 func (r *Room) Start() {
+	r.StartSeeded(rand.Int63())
+}
+
+// StartSeeded is Start with a given simulation seed. Players enter the
+// simulation sorted by id, so the seed and the inputs decide the match.
+func (r *Room) StartSeeded(seed int64) {
+	r.sim = NewSimulation(r.m, seed)
+	r.sim.SetMaxRewind(r.maxRewind)
+	r.rec = nil
+	ids := make([]string, 0, len(r.players))
+	for id := range r.players {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		r.sim.AddPlayer(id)
+	}
+
 	r.started = true
 	r.finished = false
 	r.gameOverSent = false
 	r.winnerID = ""
+	r.endReason = ""
+	// clients drop their snapshots on game_start
+	clear(r.deltas)
 	for _, p := range r.players {
 		p.ready = false
-		p.hp = 100
-		p.score = 0
-		p.cooldown = 0
+		p.inputs = nil
+		// clients number their inputs from 1 again after game_start
+		p.ack = 0
+		p.lastInput = 0
+		p.afk = false
+	}
+}
+
+// Reset takes a finished room back to the lobby. Scores and the winner stay
+// for display until the next Start.
+func (r *Room) Reset() {
+	r.started = false
+	r.finished = false
+	r.gameOverSent = false
+	r.endReason = ""
+	for _, p := range r.players {
+		p.ready = false
+		p.inputs = nil
+	}
+}
+
+// Finish ends a running match early; the current leader wins.
+func (r *Room) Finish(reason string) {
+	if !r.started || r.finished {
+		return
+	}
+	r.finished = true
+	r.endReason = reason
+	if ranks := r.Rankings(); len(ranks) > 0 {
+		r.winnerID = ranks[0].ID
 	}
 }
 
@@ -250,117 +469,124 @@ func (r *Room) ConfigureForStart(winScore *int, showEnemiesOnMap *bool, wallText
 	}
 }
 
-func (r *Room) SetInput(id string, in InputReq) {
-	if p := r.players[id]; p != nil {
-		p.input = in
-		p.dir = normalizeAngle(p.dir + in.Turn)
+// ConfigureJoin sets who may enter the room once a match is running.
+func (r *Room) ConfigureJoin(allowLateJoin, allowSpectators *bool) {
+	if allowLateJoin != nil {
+		r.allowLateJoin = *allowLateJoin
+	}
+	if allowSpectators != nil {
+		r.allowSpectators = *allowSpectators
 	}
 }
 
-func (r *Room) Tick() {
-	r.tick++
-
-	for _, p := range r.players {
-		r.stepPlayer(p)
-	}
-	for _, p := range r.players {
-		if p.cooldown > 0 {
-			p.cooldown--
+// ConfigureAccess sets the room size, visibility and password. A size
+// below the current player count only keeps new players out.
+func (r *Room) ConfigureAccess(maxPlayers *int, private *bool, password *string) {
+	if maxPlayers != nil {
+		n := *maxPlayers
+		if n <= 0 {
+			n = defaultRoomPlayers
 		}
-		if p.input.Shoot && p.cooldown == 0 {
-			p.cooldown = 6
-			r.shoot(p)
+		r.maxPlayers = min(max(n, minRoomPlayers), maxRoomPlayers)
+	}
+	if private != nil {
+		r.private = *private
+	}
+	if password != nil {
+		pw := []rune(strings.TrimSpace(*password))
+		if len(pw) > maxPasswordLen {
+			pw = pw[:maxPasswordLen]
 		}
-		p.input.Shoot = false
+		r.password = string(pw)
 	}
 }
 
-func (r *Room) stepPlayer(p *Player) {
-	speed := 0.08
-	dx, dy := 0.0, 0.0
-	if p.input.Forward {
-		dx += math.Cos(p.dir) * speed
-		dy += math.Sin(p.dir) * speed
-	}
-	if p.input.Back {
-		dx -= math.Cos(p.dir) * speed
-		dy -= math.Sin(p.dir) * speed
+// maxQueuedInputs bounds a player's input buffer. A client that gets
+// further ahead of the tick has its oldest inputs merged.
+const maxQueuedInputs = 8
+
+// SetInput buffers an input; Tick applies one per player and tick.
+func (r *Room) SetInput(id string, in InputReq) {
+	p := r.players[id]
+	if p == nil {
+		return
 	}
-	if p.input.Left {
-		dx += math.Cos(p.dir-math.Pi/2) * speed
-		dy += math.Sin(p.dir-math.Pi/2) * speed
+	if len(p.inputs) == maxQueuedInputs {
+		// keep the oldest input's turn and shot, only its movement is lost
+		next, old := &p.inputs[1], p.inputs[0]
+		next.Turn = clampTurn(next.Turn + old.Turn)
+		if old.Shoot && !next.Shoot {
+			next.Shoot, next.ViewTick = true, old.ViewTick
+		}
+		p.inputs = append(p.inputs[:0], p.inputs[1:]...)
 	}
-	if p.input.Right {
-		dx += math.Cos(p.dir+math.Pi/2) * speed
-		dy += math.Sin(p.dir+math.Pi/2) * speed
+	p.inputs = append(p.inputs, in)
+	if idle := (InputReq{Seq: in.Seq, ViewTick: in.ViewTick}); in != idle {
+		// clients keep sending empty inputs while the player is away, and
+		// may put the tick on screen on every one
+		p.lastInput = r.now()
 	}
+}
 
-	radius := 0.18
-	nx := p.x + dx
-	if !r.m.IsWall(nx+radius, p.y) && !r.m.IsWall(nx-radius, p.y) {
-		p.x = nx
+// nextInput takes p's oldest buffered input, if any, and acks it.
+func (p *Player) nextInput() (InputReq, bool) {
+	if len(p.inputs) == 0 {
+		return InputReq{}, false
 	}
-	ny := p.y + dy
-	if !r.m.IsWall(p.x, ny+radius) && !r.m.IsWall(p.x, ny-radius) {
-		p.y = ny
+	in := p.inputs[0]
+	p.inputs = append(p.inputs[:0], p.inputs[1:]...)
+	if in.Seq != 0 {
+		p.ack = in.Seq
 	}
+	return in, true
 }
 
-func (r *Room) shoot(shooter *Player) {
-	maxDist := 12.0
-	step := 0.05
-	hitRadius := 0.22
-	x := shooter.x
-	y := shooter.y
-	vx := math.Cos(shooter.dir)
-	vy := math.Sin(shooter.dir)
-
-	for d := 0.0; d < maxDist; d += step {
-		x += vx * step
-		y += vy * step
-		if r.m.IsWall(x, y) {
-			return
+// CheckAFK flags connected players that sent no input for afk ticks and
+// returns those idle for kick ticks. It reports whether any flag changed.
+func (r *Room) CheckAFK(afk, kick uint64) (changed bool, idle []string) {
+	for _, p := range r.players {
+		if p.disconnected {
+			continue
+		}
+		d := r.now() - p.lastInput
+		if away := d >= afk; away != p.afk {
+			p.afk = away
+			changed = true
 		}
-		for _, target := range r.players {
-			if target.id == shooter.id || target.hp <= 0 {
-				continue
-			}
-			if (target.x-x)*(target.x-x)+(target.y-y)*(target.y-y) <= hitRadius*hitRadius {
-				target.hp -= 35
-				if target.hp <= 0 {
-					shooter.score++
-					if !r.finished && shooter.score >= r.winScore {
-						r.finished = true
-						r.winnerID = shooter.id
-					}
-					r.respawn(target)
-				}
-				return
-			}
+		if d >= kick {
+			idle = append(idle, p.id)
 		}
 	}
+	return changed, idle
 }
 
-func (r *Room) respawn(p *Player) {
-	spawns := [][2]float64{
-		{2.5, 2.5},
-		{13.5, 2.5},
-		{2.5, 8.5},
-		{13.5, 8.5},
-	}
-	spawn := spawns[int(r.tick)%len(spawns)]
-	p.x = spawn[0]
-	p.y = spawn[1]
-	p.hp = 100
-	p.dir = 0
+// SetMaxRewind sets how many ticks shots may be rewound for lag
+// compensation in the next matches; 0 turns it off.
+func (r *Room) SetMaxRewind(ticks uint64) {
+	r.maxRewind = ticks
 }
 
-func normalizeAngle(a float64) float64 {
-	for a < -math.Pi {
-		a += 2 * math.Pi
+// Tick feeds each player's next input to the simulation and ends the
+// match once someone reaches the win score.
+func (r *Room) Tick() {
+	inputs := make(map[string]InputReq, len(r.players))
+	for _, p := range r.players {
+		if p.disconnected {
+			// a dropped player stands still instead of replaying the last input
+			inputs[p.id] = InputReq{}
+		} else if in, ok := p.nextInput(); ok {
+			inputs[p.id] = in
+		}
 	}
-	for a > math.Pi {
-		a -= 2 * math.Pi
+	if r.rec != nil {
+		r.rec.tick(inputs)
+	}
+	ev := r.sim.Step(inputs)
+	r.hits = ev.Hits
+	for _, hit := range ev.Hits {
+		if hit.Kill && !r.finished && r.sim.Score(hit.ShooterID) >= r.winScore {
+			r.finished = true
+			r.winnerID = hit.ShooterID
+		}
 	}
-	return a
 }
@@ -0,0 +1,282 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Every room runs on its own goroutine. Joins, inputs, ticks and broadcasts
+// for a room are funnelled through its inbox, so a busy room never stalls
+// the others and Hub.mu only guards the client/room registries.
+//
+// Never call into a room (do/call) while holding Hub.mu: room goroutines
+// take Hub.mu themselves.
+
+var errRoomClosed = errors.New("room closed")
+
+const roomInboxSize = 256
+
+// startRoom attaches r to the hub and starts its goroutine.
+func (h *Hub) startRoom(r *Room) {
+	r.hub = h
+	r.inbox = make(chan func(), roomInboxSize)
+	r.done = make(chan struct{})
+	r.members = map[string]*Client{}
+	r.deltas = map[string]*deltaState{}
+	r.lastActive = time.Now()
+	if h.cfg.MaxRewind > 0 {
+		r.SetMaxRewind(uint64(h.cfg.MaxRewind / h.cfg.Tick))
+	}
+	r.publish()
+	go r.loop()
+}
+
+func (r *Room) loop() {
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+		close(r.done)
+	}()
+
+	for {
+		select {
+		case fn := <-r.inbox:
+			fn()
+		case <-tick:
+			r.step()
+		}
+
+		if r.closed {
+			return
+		}
+		switch running := r.ticking(); {
+		case running && ticker == nil:
+			ticker = time.NewTicker(r.hub.tick)
+			tick = ticker.C
+		case !running && ticker != nil:
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		r.publish()
+	}
+}
+
+// do queues fn to run on the room goroutine.
+func (r *Room) do(fn func()) error {
+	select {
+	case r.inbox <- fn:
+		return nil
+	case <-r.done:
+		return errRoomClosed
+	}
+}
+
+// call runs fn on the room goroutine and waits for it to finish.
+func (r *Room) call(fn func()) error {
+	finished := make(chan struct{})
+	if err := r.do(func() {
+		fn()
+		close(finished)
+	}); err != nil {
+		return err
+	}
+	select {
+	case <-finished:
+		return nil
+	case <-r.done:
+		select {
+		case <-finished:
+			return nil
+		default:
+			return errRoomClosed
+		}
+	}
+}
+
+// ticking reports whether the match loop should run: from Start until
+// game_over has been sent. After that the room shows the results until
+// returnToLobby.
+func (r *Room) ticking() bool {
+	return r.started && !r.gameOverSent
+}
+
+// publish makes the lobby summary readable from other goroutines.
+func (r *Room) publish() {
+	s := r.Summary()
+	r.summary.Store(&s)
+}
+
+// announce publishes the summary and refreshes the lobby listings.
+func (r *Room) announce() {
+	r.publish()
+	r.hub.broadcastRooms()
+}
+
+func (r *Room) step() {
+	r.Tick()
+	if r.hub.cfg.LogHits {
+		for _, hit := range r.hits {
+			log.Printf("room %s: tick %d: %s hit %s at (%.2f, %.2f), rewound %d ticks, kill=%v",
+				r.id, hit.Tick, hit.ShooterID, hit.TargetID, hit.TargetX, hit.TargetY, hit.Rewind, hit.Kill)
+		}
+	}
+	r.sendStates(r.GameState())
+
+	if r.finished && !r.gameOverSent {
+		r.gameOverSent = true
+		r.hub.matches.Done()
+		delay := r.hub.cfg.ReturnToLobby
+		r.broadcast("game_over", GameOverMsg{
+			RoomID:   r.id,
+			RoomName: r.name,
+			WinnerID: r.winnerID,
+			WinScore: r.winScore,
+			Rankings: r.Rankings(),
+			Reason:   r.endReason,
+			ReturnAt: time.Now().Add(delay).UnixMilli(),
+
+			RecordingID: r.saveRecording(),
+		})
+		r.scheduleReturn(delay)
+	}
+	if r.ticking() {
+		r.checkAFK()
+	}
+}
+
+// checkAFK updates the AFK flags and removes players that stayed AFK for
+// Config.AFKKickTimeout. Their clients are disconnected too: nobody is
+// at them, and an unattended tab would hold its connection forever.
+func (r *Room) checkAFK() {
+	cfg := r.hub.cfg
+	afk := uint64(cfg.AFKTimeout / cfg.Tick)
+	changed, idle := r.CheckAFK(afk, afk+uint64(cfg.AFKKickTimeout/cfg.Tick))
+	for _, id := range idle {
+		log.Printf("room %s: removing AFK player %s", r.id, id)
+		c := r.members[id]
+		r.kick(id, false, kickAFK)
+		if c != nil {
+			r.hub.closeClient(c, closeKicked, "afk")
+		}
+		if r.closed {
+			return
+		}
+	}
+	if changed && len(idle) == 0 {
+		// kick has broadcast the state already
+		r.broadcastState()
+	}
+}
+
+// scheduleReturn sends the room back to the lobby after d, unless a
+// room_rematch does it first.
+func (r *Room) scheduleReturn(d time.Duration) {
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		_ = r.do(func() {
+			if r.lobbyTimer == t {
+				r.returnToLobby()
+			}
+		})
+	})
+	r.lobbyTimer = t
+}
+
+// returnToLobby ends the post-match phase: the room can be joined and
+// started again. Players who dropped out during the match give up their
+// slot, since there is no match left to resume.
+func (r *Room) returnToLobby() {
+	if r.lobbyTimer != nil {
+		r.lobbyTimer.Stop()
+		r.lobbyTimer = nil
+	}
+	r.Reset()
+	for id, p := range r.players {
+		if p.disconnected {
+			r.removePlayer(id)
+		}
+	}
+	if r.closed {
+		return
+	}
+	r.broadcastState()
+	r.announce()
+}
+
+func (r *Room) broadcast(typ string, payload any) {
+	r.lastActive = time.Now()
+	msg, _ := json.Marshal(Envelope{Type: typ, Payload: mustJSON(payload)})
+	for _, c := range r.members {
+		r.hub.sendRaw(c, msg)
+	}
+}
+
+func (r *Room) broadcastState() {
+	r.broadcast("room_state", r.State())
+}
+
+// kickAFK is the RoomKickedMsg reason for idle players.
+const kickAFK = "afk"
+
+// kick removes a player or spectator on the host's (or for reason kickAFK,
+// the server's) behalf. A connected client is told and sent back to the
+// lobby.
+func (r *Room) kick(id string, banned bool, reason string) {
+	h := r.hub
+	c := r.members[id]
+	if c != nil {
+		h.mu.Lock()
+		if c.roomID == r.id {
+			c.roomID = ""
+		}
+		h.mu.Unlock()
+		h.send(c, "room_kicked", RoomKickedMsg{RoomID: r.id, Banned: banned, Reason: reason})
+	}
+	r.removePlayer(id)
+	if c != nil {
+		h.sendRooms(c, "")
+	}
+}
+
+// removePlayer drops a player or spectator and closes the room once no
+// player is left.
+func (r *Room) removePlayer(id string) {
+	r.RemovePlayer(id)
+	delete(r.members, id)
+	if len(r.players) > 0 {
+		r.broadcastState()
+		r.announce()
+		return
+	}
+
+	r.close()
+}
+
+// close shuts the room down and sends anyone still in it back to the
+// lobby.
+func (r *Room) close() {
+	r.closed = true
+	// a match nobody is left to finish is not worth replaying
+	r.rec = nil
+	if r.ticking() {
+		r.hub.matches.Done()
+	}
+	r.broadcast("room_closed", RoomClosedMsg{RoomID: r.id})
+	h := r.hub
+	h.mu.Lock()
+	if h.rooms[r.id] == r {
+		delete(h.rooms, r.id)
+	}
+	for _, c := range r.members {
+		if c.roomID == r.id {
+			c.roomID = ""
+		}
+	}
+	h.mu.Unlock()
+	h.broadcastRooms()
+}
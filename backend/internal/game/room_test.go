@@ -0,0 +1,35 @@
+package game
+
+import "testing"
+
+func TestIdleInputsGoAFK(t *testing.T) {
+	r := NewRoom("r_test", "test", "a")
+	r.AddPlayer("a", "a")
+	r.Start()
+
+	const afk, kick = 10, 20
+	for seq := uint32(1); seq <= kick; seq++ {
+		// what a client sends while its player is away: numbered, with
+		// the snapshot on screen, but no keys pressed
+		r.SetInput("a", InputReq{Seq: seq, ViewTick: r.now()})
+		r.Tick()
+		changed, idle := r.CheckAFK(afk, kick)
+		p := r.players["a"]
+		switch {
+		case seq < afk && p.afk:
+			t.Fatalf("tick %d: AFK too early", seq)
+		case seq == afk && (!p.afk || !changed):
+			t.Fatalf("tick %d: not marked AFK", seq)
+		case seq < kick && len(idle) > 0:
+			t.Fatalf("tick %d: kicked too early", seq)
+		case seq == kick && (len(idle) != 1 || idle[0] != "a"):
+			t.Fatalf("tick %d: idle = %v, want [a]", seq, idle)
+		}
+	}
+
+	r.SetInput("a", InputReq{Seq: kick + 1, ViewTick: r.now(), Forward: true})
+	r.Tick()
+	if changed, _ := r.CheckAFK(afk, kick); !changed || r.players["a"].afk {
+		t.Fatal("moving did not clear AFK")
+	}
+}
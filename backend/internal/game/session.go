@@ -0,0 +1,124 @@
+package game
+
+import "time"
+
+// session outlives a single connection so a dropped player can resume.
+type session struct {
+	token  string
+	userID string
+	name   string
+
+	// roomID is the room holding the player's slot while no connection is
+	// attached; expire is the timer that gives the slot up
+	roomID string
+	expire *time.Timer
+}
+
+// detach keeps a disconnecting client's slot in a running match for the
+// resume grace period. It reports whether the slot was kept.
+func (h *Hub) detach(c *Client, room *Room, s *session) bool {
+	kept := false
+	_ = room.call(func() {
+		if room.members[c.id] != c || !room.HasPlayer(c.id) || !room.started || room.finished {
+			return
+		}
+		delete(room.members, c.id)
+		room.SetConnected(c.id, false)
+		room.broadcastState()
+		kept = true
+	})
+	if !kept {
+		return false
+	}
+
+	h.mu.Lock()
+	s.roomID = room.id
+	s.expire = time.AfterFunc(h.cfg.ResumeGrace, func() {
+		h.expireSession(s.token)
+	})
+	h.mu.Unlock()
+	return true
+}
+
+func (h *Hub) expireSession(token string) {
+	h.mu.Lock()
+	s := h.sessions[token]
+	if s == nil || s.expire == nil {
+		// resumed in the meantime
+		h.mu.Unlock()
+		return
+	}
+	delete(h.sessions, token)
+	h.mu.Unlock()
+
+	h.removePlayer(s.roomID, s.userID)
+}
+
+// handleResume binds c to an existing session: it takes over the user id,
+// name and room slot, replacing the old connection if that one is still
+// around.
+func (h *Hub) handleResume(c *Client, id string, req ResumeReq) error {
+	h.mu.Lock()
+	if c.name != "" {
+		h.mu.Unlock()
+		return errAlreadyAuthenticated
+	}
+	s := h.sessions[req.Token]
+	if s == nil {
+		h.mu.Unlock()
+		return errResumeFailed
+	}
+	if !h.negotiate(c, id, req.Version, req.MinVersion, req.Caps, req.Encodings) {
+		h.mu.Unlock()
+		return nil
+	}
+
+	old := h.clients[s.userID]
+	roomID := s.roomID
+	if old != nil {
+		roomID = old.roomID
+	}
+	if s.expire != nil {
+		s.expire.Stop()
+		s.expire = nil
+	}
+	s.roomID = ""
+
+	delete(h.clients, c.id)
+	c.id = s.userID
+	c.name = s.name
+	c.token = s.token
+	h.clients[c.id] = c
+
+	room := h.rooms[roomID]
+	h.mu.Unlock()
+
+	if old != nil {
+		h.closeClient(old, closeReplaced, "session resumed elsewhere")
+	}
+	h.reply(c, id, "hello_ack", h.helloAck(c))
+
+	rejoined := false
+	if room != nil {
+		_ = room.call(func() {
+			if !room.HasPlayer(c.id) {
+				return
+			}
+			rejoined = true
+			room.members[c.id] = c
+			room.SetConnected(c.id, true)
+			room.broadcastState()
+			if room.started {
+				h.send(c, "game_start", h.gameStart(room))
+			}
+		})
+	}
+	if !rejoined {
+		h.sendRooms(c, "")
+		return nil
+	}
+	h.mu.Lock()
+	c.roomID = room.id
+	h.mu.Unlock()
+	return nil
+}
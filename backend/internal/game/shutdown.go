@@ -0,0 +1,103 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const endReasonShutdown = "server_shutdown"
+
+func (h *Hub) Draining() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining
+}
+
+// Shutdown drains the hub: new connections, rooms and matches are refused,
+// clients are told when the server goes away, running matches get until
+// ctx's deadline to finish and are then ended with the current rankings.
+// Finally every socket is closed with a going-away status.
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.mu.Lock()
+	h.draining = true
+	h.mu.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now()
+	}
+	notice, _ := json.Marshal(Envelope{Type: "server_shutdown", Payload: mustJSON(ServerShutdownMsg{
+		Deadline: deadline.UnixMilli(),
+		Reason:   "server restarting",
+	})})
+	for _, c := range h.allClients() {
+		h.sendRaw(c, notice)
+	}
+
+	if !h.waitMatches(ctx) {
+		// out of time: the room loops send game_over on their next tick
+		for _, room := range h.allRooms() {
+			_ = room.do(func() {
+				room.Finish(endReasonShutdown)
+			})
+		}
+		wctx, cancel := context.WithTimeout(context.Background(), 2*h.tick)
+		h.waitMatches(wctx)
+		cancel()
+	}
+
+	for _, c := range h.allClients() {
+		h.closeClient(c, closeShutdown, "server shutting down")
+	}
+	h.waitClients(closeTimeout)
+}
+
+func (h *Hub) allClients() []*Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (h *Hub) allRooms() []*Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// waitMatches reports whether all room loops ended before ctx was done.
+func (h *Hub) waitMatches(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		h.matches.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitClients gives the close handshakes up to d to complete.
+func (h *Hub) waitClients(d time.Duration) {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		n := len(h.clients)
+		h.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,329 @@
+package game
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Simulation is the game logic of one match: movement, shooting, scoring.
+// It knows nothing about rooms, clients or wall clock time. Players are
+// kept in the order they were added and all randomness comes from the
+// seed, so the same seed, players and inputs always give the same match;
+// that is what makes matches testable and replayable.
+type Simulation struct {
+	m    Map
+	seed int64
+	rng  *rand.Rand
+	tick uint64
+
+	// players in the order they were added; every loop over them uses it
+	players []*simPlayer
+
+	// history holds the player positions of the last maxRewind ticks for
+	// lag compensation, indexed by tick modulo its length
+	history   []posFrame
+	maxRewind uint64
+}
+
+type simPlayer struct {
+	id       string
+	x, y     float64
+	dir      float64
+	hp       int
+	score    int
+	cooldown int
+	// input is applied every tick until the next one arrives
+	input InputReq
+	// spawned is the tick of the last respawn; older positions are not
+	// used for lag compensation
+	spawned uint64
+}
+
+// Events is what happened during a Step.
+type Events struct {
+	Hits []Hit
+}
+
+// Hit is a shot that landed. TargetX/TargetY is where the target was hit:
+// its position Rewind ticks before the shot, as the shooter saw it.
+type Hit struct {
+	Tick      uint64
+	ShooterID string
+	TargetID  string
+	Rewind    uint64
+	TargetX   float64
+	TargetY   float64
+	Kill      bool
+}
+
+// posFrame is where the players were at the end of a tick.
+type posFrame struct {
+	tick    uint64
+	players []playerPos
+}
+
+type playerPos struct {
+	id   string
+	x, y float64
+}
+
+var spawns = [][2]float64{
+	{2.5, 2.5},
+	{13.5, 2.5},
+	{2.5, 8.5},
+	{13.5, 8.5},
+}
+
+func NewSimulation(m Map, seed int64) *Simulation {
+	return &Simulation{
+		m:    m,
+		seed: seed,
+		rng:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (s *Simulation) Seed() int64  { return s.seed }
+func (s *Simulation) Tick() uint64 { return s.tick }
+
+// SetMaxRewind sets how many ticks shots may be rewound for lag
+// compensation; 0 turns it off.
+func (s *Simulation) SetMaxRewind(ticks uint64) {
+	s.maxRewind = ticks
+	s.history = nil
+	if ticks > 0 {
+		s.history = make([]posFrame, ticks+1)
+	}
+}
+
+// AddPlayer puts a new player on the next spawn point.
+func (s *Simulation) AddPlayer(id string) {
+	if s.player(id) != nil {
+		return
+	}
+	spawn := spawns[len(s.players)%len(spawns)]
+	s.players = append(s.players, &simPlayer{
+		id:      id,
+		x:       spawn[0],
+		y:       spawn[1],
+		hp:      100,
+		spawned: s.tick,
+	})
+}
+
+func (s *Simulation) RemovePlayer(id string) {
+	for i, p := range s.players {
+		if p.id == id {
+			s.players = append(s.players[:i], s.players[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Simulation) player(id string) *simPlayer {
+	for _, p := range s.players {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// Score returns id's kills, 0 for unknown players.
+func (s *Simulation) Score(id string) int {
+	if p := s.player(id); p != nil {
+		return p.score
+	}
+	return 0
+}
+
+// Frames returns the players' state in simulation order. Names and acks
+// are left for the caller.
+func (s *Simulation) Frames() []PlayerFrame {
+	out := make([]PlayerFrame, 0, len(s.players))
+	for _, p := range s.players {
+		out = append(out, PlayerFrame{
+			ID:    p.id,
+			X:     p.x,
+			Y:     p.y,
+			Dir:   p.dir,
+			HP:    p.hp,
+			Score: p.score,
+		})
+	}
+	return out
+}
+
+// Step advances the match by one tick. inputs holds at most one new input
+// per player id; a player without one keeps moving as before, but does
+// not turn or shoot again.
+func (s *Simulation) Step(inputs map[string]InputReq) Events {
+	s.tick++
+	var ev Events
+
+	for _, p := range s.players {
+		if in, ok := inputs[p.id]; ok {
+			p.input = in
+			p.dir = normalizeAngle(p.dir + clampTurn(in.Turn))
+		} else {
+			p.input.Turn, p.input.Shoot = 0, false
+		}
+		s.move(p)
+	}
+	for _, p := range s.players {
+		if p.cooldown > 0 {
+			p.cooldown--
+		}
+		if p.input.Shoot && p.cooldown == 0 {
+			p.cooldown = 6
+			if hit, ok := s.shoot(p); ok {
+				ev.Hits = append(ev.Hits, hit)
+			}
+		}
+		p.input.Shoot = false
+	}
+	s.record()
+	return ev
+}
+
+// record stores this tick's positions in the history.
+func (s *Simulation) record() {
+	if len(s.history) == 0 {
+		return
+	}
+	f := &s.history[s.tick%uint64(len(s.history))]
+	f.tick = s.tick
+	f.players = f.players[:0]
+	for _, p := range s.players {
+		f.players = append(f.players, playerPos{id: p.id, x: p.x, y: p.y})
+	}
+}
+
+// rewind returns the positions a shot fired while viewing tick view is
+// tested against, at most maxRewind ticks back, and how far back that is.
+// It returns nil for the current positions.
+func (s *Simulation) rewind(view uint64) (*posFrame, uint64) {
+	if view == 0 || view >= s.tick || len(s.history) == 0 {
+		return nil, 0
+	}
+	if s.tick-view > s.maxRewind {
+		view = s.tick - s.maxRewind
+	}
+	f := &s.history[view%uint64(len(s.history))]
+	if f.tick != view {
+		// before the match started
+		return nil, 0
+	}
+	return f, s.tick - view
+}
+
+func (s *Simulation) move(p *simPlayer) {
+	speed := 0.08
+	dx, dy := 0.0, 0.0
+	if p.input.Forward {
+		dx += math.Cos(p.dir) * speed
+		dy += math.Sin(p.dir) * speed
+	}
+	if p.input.Back {
+		dx -= math.Cos(p.dir) * speed
+		dy -= math.Sin(p.dir) * speed
+	}
+	if p.input.Left {
+		dx += math.Cos(p.dir-math.Pi/2) * speed
+		dy += math.Sin(p.dir-math.Pi/2) * speed
+	}
+	if p.input.Right {
+		dx += math.Cos(p.dir+math.Pi/2) * speed
+		dy += math.Sin(p.dir+math.Pi/2) * speed
+	}
+
+	radius := 0.18
+	nx := p.x + dx
+	if !s.m.IsWall(nx+radius, p.y) && !s.m.IsWall(nx-radius, p.y) {
+		p.x = nx
+	}
+	ny := p.y + dy
+	if !s.m.IsWall(p.x, ny+radius) && !s.m.IsWall(p.x, ny-radius) {
+		p.y = ny
+	}
+}
+
+// shoot fires a hitscan shot. Targets are tested where the shooter saw
+// them (see rewind), unless they respawned since; walls and the shooter
+// are current.
+func (s *Simulation) shoot(shooter *simPlayer) (Hit, bool) {
+	maxDist := 12.0
+	step := 0.05
+	hitRadius := 0.22
+	x := shooter.x
+	y := shooter.y
+	vx := math.Cos(shooter.dir)
+	vy := math.Sin(shooter.dir)
+
+	frame, back := s.rewind(shooter.input.ViewTick)
+	targetPos := func(t *simPlayer) (float64, float64, uint64) {
+		if frame == nil || t.spawned > frame.tick {
+			return t.x, t.y, 0
+		}
+		for _, pos := range frame.players {
+			if pos.id == t.id {
+				return pos.x, pos.y, back
+			}
+		}
+		// joined since
+		return t.x, t.y, 0
+	}
+
+	for d := 0.0; d < maxDist; d += step {
+		x += vx * step
+		y += vy * step
+		if s.m.IsWall(x, y) {
+			return Hit{}, false
+		}
+		for _, target := range s.players {
+			if target.id == shooter.id || target.hp <= 0 {
+				continue
+			}
+			tx, ty, rewound := targetPos(target)
+			if (tx-x)*(tx-x)+(ty-y)*(ty-y) <= hitRadius*hitRadius {
+				target.hp -= 35
+				hit := Hit{
+					Tick:      s.tick,
+					ShooterID: shooter.id,
+					TargetID:  target.id,
+					Rewind:    rewound,
+					TargetX:   tx,
+					TargetY:   ty,
+					Kill:      target.hp <= 0,
+				}
+				if hit.Kill {
+					shooter.score++
+					s.respawn(target)
+				}
+				return hit, true
+			}
+		}
+	}
+	return Hit{}, false
+}
+
+func (s *Simulation) respawn(p *simPlayer) {
+	spawn := spawns[s.rng.Intn(len(spawns))]
+	p.x = spawn[0]
+	p.y = spawn[1]
+	p.hp = 100
+	p.dir = 0
+	p.spawned = s.tick
+}
+
+func normalizeAngle(a float64) float64 {
+	return math.Remainder(a, 2*math.Pi)
+}
+
+// clampTurn bounds the turn of one input to half a revolution either way.
+// A turn that is not a number counts as none.
+func clampTurn(t float64) float64 {
+	if math.IsNaN(t) || math.IsInf(t, 0) {
+		return 0
+	}
+	return max(-math.Pi, min(t, math.Pi))
+}
@@ -0,0 +1,95 @@
+package game
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// simRun is everything a match produced, tick by tick.
+type simRun struct {
+	frames [][]PlayerFrame
+	hits   []Hit
+}
+
+// playMatch plays ticks of a four player match where everyone runs,
+// turns and shoots at random, the randomness coming from inputSeed.
+func playMatch(seed, inputSeed int64, ticks int) simRun {
+	ids := []string{"a", "b", "c", "d"}
+	s := NewSimulation(DefaultMap(), seed)
+	s.SetMaxRewind(10)
+	for _, id := range ids {
+		s.AddPlayer(id)
+	}
+	rng := rand.New(rand.NewSource(inputSeed))
+	var out simRun
+	for i := 0; i < ticks; i++ {
+		inputs := map[string]InputReq{}
+		for _, id := range ids {
+			if rng.Intn(3) == 0 {
+				// no new input this tick
+				continue
+			}
+			in := inputFromFlags(byte(rng.Intn(1 << 5)))
+			in.Turn = rng.Float64() - 0.5
+			in.ViewTick = s.Tick() - uint64(rng.Intn(5))
+			inputs[id] = in
+		}
+		ev := s.Step(inputs)
+		out.frames = append(out.frames, s.Frames())
+		out.hits = append(out.hits, ev.Hits...)
+	}
+	return out
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	first := playMatch(42, 7, 2000)
+	if len(first.hits) == 0 {
+		t.Fatal("no hits in 2000 ticks; the match tests nothing")
+	}
+	second := playMatch(42, 7, 2000)
+	for i := range first.frames {
+		if !reflect.DeepEqual(first.frames[i], second.frames[i]) {
+			t.Fatalf("tick %d: frames differ\n%+v\n%+v", i+1, first.frames[i], second.frames[i])
+		}
+	}
+	if !reflect.DeepEqual(first.hits, second.hits) {
+		t.Fatalf("hits differ\n%+v\n%+v", first.hits, second.hits)
+	}
+
+	if other := playMatch(43, 7, 2000); reflect.DeepEqual(first, other) {
+		t.Error("another seed played the same match")
+	}
+}
+
+func FuzzSimulationStep(f *testing.F) {
+	f.Add(int64(1), 0.1, byte(inputForward|inputShoot), uint64(0))
+	f.Add(int64(2), 1e20, byte(0xff), uint64(3))
+	f.Add(int64(3), -1e300, byte(inputBack|inputLeft), uint64(math.MaxUint64))
+	f.Add(int64(4), math.Inf(1), byte(inputRight), uint64(1))
+	f.Add(int64(5), math.NaN(), byte(inputForward), uint64(0))
+	f.Fuzz(func(t *testing.T, seed int64, turn float64, keys byte, viewTick uint64) {
+		m := DefaultMap()
+		s := NewSimulation(m, seed)
+		s.SetMaxRewind(5)
+		s.AddPlayer("a")
+		s.AddPlayer("b")
+		for i := 0; i < 50; i++ {
+			in := inputFromFlags(keys)
+			in.Turn, in.Shoot, in.ViewTick = turn, true, viewTick
+			s.Step(map[string]InputReq{"a": in, "b": {Turn: -turn, Shoot: true}})
+			for _, p := range s.Frames() {
+				if math.IsNaN(p.Dir) || p.Dir < -math.Pi || p.Dir > math.Pi {
+					t.Fatalf("tick %d: %s faces %v", s.Tick(), p.ID, p.Dir)
+				}
+				if m.IsWall(p.X, p.Y) {
+					t.Fatalf("tick %d: %s is in a wall at (%v, %v)", s.Tick(), p.ID, p.X, p.Y)
+				}
+				if p.HP <= 0 || p.HP > 100 {
+					t.Fatalf("tick %d: %s has %d hp", s.Tick(), p.ID, p.HP)
+				}
+			}
+		}
+	})
+}
@@ -1,13 +1,49 @@
 package game
 
-import "fps-backend/internal/ws"
+import (
+	"sync"
+	"sync/atomic"
+
+	"fps-backend/internal/ws"
+)
 
 type Client struct {
 	id   string
 	name string
+	// token is the resume token handed out in hello_ack
+	token string
 
 	roomID string
 
-	conn *ws.Conn
-	send chan []byte
+	// version and caps are the negotiated protocol, fixed by the first
+	// hello (or resume); room loops read them without the lock
+	version int
+	caps    []string
+	// binary and delta cache has(CapBinaryV1) and has(CapDeltaV1) for the
+	// hot path
+	binary bool
+	delta  bool
+
+	conn  *ws.Conn
+	queue *sendQueue
+
+	// lastPong is the unix nano time of the last pong (or of the
+	// connection), updated by the read loop and checked by the write loop
+	lastPong atomic.Int64
+
+	// flood is the rate limiting state, see ratelimit.go
+	flood flood
+
+	closeOnce   sync.Once
+	closing     chan struct{}
+	closeCode   int
+	closeReason string
+}
+
+// ID is the user id, stable across resumes.
+func (c *Client) ID() string { return c.id }
+
+type outMsg struct {
+	data   []byte
+	binary bool
 }
@@ -0,0 +1,215 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DialOptions configures the client handshake.
+type DialOptions struct {
+	// Header is sent with the handshake request (e.g. Origin, cookies).
+	Header http.Header
+	// Subprotocols offered to the server, preferred first.
+	Subprotocols []string
+	// Compression offers permessage-deflate when Enabled.
+	Compression CompressionOptions
+	// TLSConfig is used for wss:// URLs.
+	TLSConfig *tls.Config
+}
+
+// Dial opens a client connection to a ws:// or wss:// URL. The handshake is
+// bounded by ctx. The returned Conn masks everything it writes, as RFC 6455
+// requires of clients, and otherwise behaves like a server side Conn.
+func Dial(ctx context.Context, rawURL string, opts DialOptions) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var useTLS bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		useTLS = true
+	default:
+		return nil, nil, fmt.Errorf("ws: unsupported scheme %q", u.Scheme)
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		if useTLS {
+			hostPort = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			hostPort = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	if useTLS {
+		cfg := opts.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(netConn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = netConn.Close()
+			return nil, nil, err
+		}
+		netConn = tc
+	}
+
+	// abort the handshake when ctx ends by expiring the socket deadline
+	stop := context.AfterFunc(ctx, func() {
+		_ = netConn.SetDeadline(time.Unix(1, 0))
+	})
+	conn, resp, err := clientHandshake(netConn, u, opts)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = netConn.Close()
+		return nil, resp, err
+	}
+	return conn, resp, nil
+}
+
+func clientHandshake(netConn net.Conn, u *url.URL, opts DialOptions) (*Conn, *http.Response, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.EscapedPath(), RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if len(opts.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(opts.Subprotocols, ", "))
+	}
+	if opts.Compression.Enabled {
+		offer := "permessage-deflate"
+		if opts.Compression.ClientNoContextTakeover {
+			offer += "; client_no_context_takeover"
+		}
+		if opts.Compression.ServerNoContextTakeover {
+			offer += "; server_no_context_takeover"
+		}
+		req.Header.Set("Sec-WebSocket-Extensions", offer)
+	}
+
+	bw := bufio.NewWriter(netConn)
+	if err := req.Write(bw); err != nil {
+		return nil, nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp, fmt.Errorf("ws: handshake failed with status %s", resp.Status)
+	}
+	if !headerContainsToken(resp.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "Upgrade") {
+		return nil, resp, errors.New("ws: server did not upgrade the connection")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != computeAccept(key) {
+		return nil, resp, errors.New("ws: bad Sec-WebSocket-Accept")
+	}
+
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !containsToken(opts.Subprotocols, subprotocol) {
+		return nil, resp, fmt.Errorf("ws: server selected unoffered subprotocol %q", subprotocol)
+	}
+
+	var deflate *deflateState
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		if !opts.Compression.Enabled {
+			return nil, resp, fmt.Errorf("ws: server selected unoffered extension %q", ext)
+		}
+		p, err := parseDeflateResponse(ext)
+		if err != nil {
+			return nil, resp, err
+		}
+		deflate = newDeflateState(p, opts.Compression.Level, false)
+	}
+
+	return &Conn{
+		c:              netConn,
+		br:             br,
+		bw:             bw,
+		client:         true,
+		maxMessageSize: DefaultMaxMessageSize,
+		subprotocol:    subprotocol,
+		deflate:        deflate,
+		closeRecv:      make(chan struct{}),
+	}, resp, nil
+}
+
+// parseDeflateResponse validates the server's permessage-deflate answer.
+// We never offer client_max_window_bits, so the server must not send it.
+func parseDeflateResponse(ext string) (deflateParams, error) {
+	parts := strings.Split(ext, ";")
+	if !strings.EqualFold(strings.TrimSpace(parts[0]), "permessage-deflate") || strings.Contains(ext, ",") {
+		return deflateParams{}, fmt.Errorf("ws: unsupported extension response %q", ext)
+	}
+	var p deflateParams
+	for _, param := range parts[1:] {
+		name, _, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "server_no_context_takeover":
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			// any server window fits in our 32KB inflate window
+		default:
+			return deflateParams{}, fmt.Errorf("ws: unsupported permessage-deflate parameter %q", name)
+		}
+	}
+	return p, nil
+}
+
+func containsToken(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestDial(t *testing.T) {
+	u := Upgrader{
+		Subprotocols: []string{"fps.v2", "fps.v1"},
+		Compression:  CompressionOptions{Enabled: true},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.EnableWriteCompression(true)
+		for {
+			op, msg, err := c.ReadMessage()
+			if err != nil {
+				_ = c.CloseWithStatus(CloseNormalClosure, "", time.Second)
+				return
+			}
+			_ = c.WriteMessage(op, msg)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, resp, err := Dial(ctx, wsURL(srv)+"/ws?x=1", DialOptions{
+		Subprotocols: []string{"fps.v1", "fps.v2"},
+		Compression:  CompressionOptions{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// the server's preference wins
+	if c.Subprotocol() != "fps.v2" {
+		t.Fatalf("subprotocol %q, want fps.v2", c.Subprotocol())
+	}
+	if !c.CompressionNegotiated() {
+		t.Fatal("permessage-deflate not negotiated")
+	}
+	c.EnableWriteCompression(true)
+	// the server only accepts masked frames, so an echo proves the masking
+	for _, msg := range []string{"hi", strings.Repeat("compress me ", 100)} {
+		if err := c.WriteText([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.ReadText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Fatalf("echo %q, want %q", got, msg)
+		}
+	}
+	if err := c.WriteClose(CloseNormalClosure, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadText(); CloseCode(err) != CloseNormalClosure {
+		t.Fatalf("read after close = %v, want the server's 1000", err)
+	}
+}
+
+func TestDialRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		opts DialOptions
+		// respond writes the handshake response for a request with key
+		respond func(key string) string
+	}{
+		{
+			name: "bad accept",
+			respond: func(string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + computeAccept("not the key") + "\r\n\r\n"
+			},
+		},
+		{
+			name: "missing accept",
+			respond: func(string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+			},
+		},
+		{
+			name: "subprotocol not requested",
+			respond: func(key string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + computeAccept(key) + "\r\nSec-WebSocket-Protocol: fps.v1\r\n\r\n"
+			},
+		},
+		{
+			name: "subprotocol not offered",
+			opts: DialOptions{Subprotocols: []string{"fps.v2"}},
+			respond: func(key string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + computeAccept(key) + "\r\nSec-WebSocket-Protocol: fps.v1\r\n\r\n"
+			},
+		},
+		{
+			name: "extension not offered",
+			respond: func(key string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + computeAccept(key) + "\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n"
+			},
+		},
+		{
+			name: "no upgrade",
+			respond: func(string) string {
+				return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, buf, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = fmt.Fprint(buf, tt.respond(r.Header.Get("Sec-WebSocket-Key")))
+				_ = buf.Flush()
+			}))
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, _, err := Dial(ctx, wsURL(srv), tt.opts)
+			if err == nil {
+				c.Close()
+				t.Fatal("handshake accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Close status codes from RFC 6455 section 7.4.1. Applications may use
+// 4000-4999 for their own codes.
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// maxCloseReason keeps the close payload within the 125 byte control frame limit.
+const maxCloseReason = 123
+
+var ErrCloseSent = errors.New("ws: close frame already sent")
+
+// CloseError is returned by the read methods once the peer has sent a close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("ws: closed by peer (%d)", e.Code)
+	}
+	return fmt.Sprintf("ws: closed by peer (%d %s)", e.Code, e.Reason)
+}
+
+// CloseCode extracts the peer's close code from err, or CloseAbnormal if the
+// connection ended without a close frame.
+func CloseCode(err error) int {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return CloseAbnormal
+}
+
+// WriteClose sends a close frame without waiting for the peer's reply.
+// Later writes fail with ErrCloseSent.
+func (c *Conn) WriteClose(code int, reason string) error {
+	return c.writeFrame(opClose, closePayload(code, reason))
+}
+
+// CloseWithStatus performs the closing handshake: it sends a close frame,
+// waits up to timeout for the peer to answer and then closes the socket.
+// The reply is observed by whichever goroutine is reading from c; if no one
+// is reading, the call simply waits out the timeout. CloseAbnormal skips the
+// handshake and drops the connection.
+func (c *Conn) CloseWithStatus(code int, reason string, timeout time.Duration) error {
+	if code == CloseAbnormal {
+		return c.c.Close()
+	}
+	if err := c.WriteClose(code, reason); err != nil && !errors.Is(err, ErrCloseSent) {
+		_ = c.c.Close()
+		return err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-c.closeRecv:
+	case <-t.C:
+	}
+	return c.c.Close()
+}
+
+// handleClose answers a peer close frame (unless we started the handshake)
+// and converts it into the error returned to the reader.
+func (c *Conn) handleClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		ce.Code = CloseProtocolError
+	case len(payload) >= 2:
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			ce.Code = CloseProtocolError
+			ce.Reason = ""
+		} else if !utf8.ValidString(ce.Reason) {
+			ce.Code = CloseInvalidPayload
+			ce.Reason = ""
+		}
+	}
+	c.closeOnce.Do(func() { close(c.closeRecv) })
+
+	echo := ce.Code
+	if echo == CloseNoStatus {
+		echo = 0
+	}
+	_ = c.WriteClose(echo, "")
+	return ce
+}
+
+// validCloseCode reports whether a peer may send code in a close frame
+// (RFC 6455 section 7.4). 1005, 1006 and 1015 only exist locally, the rest
+// of 1000-2999 is reserved for the protocol and codes below 1000 are not
+// used.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1014:
+		return code != 1004 && code != CloseNoStatus && code != CloseAbnormal
+	}
+	return false
+}
+
+func closePayload(code int, reason string) []byte {
+	if code == 0 {
+		return nil
+	}
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	b := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	copy(b[2:], reason)
+	return b
+}
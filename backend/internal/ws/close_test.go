@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func closeFrame(code int, reason string) []byte {
+	if code == 0 {
+		return frame(0x88, "")
+	}
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(code))
+	return frame(0x88, string(b[:])+reason)
+}
+
+func TestCloseEcho(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		code   int
+		reason string
+		echo   int
+	}{
+		{name: "no status", frame: closeFrame(0, ""), code: CloseNoStatus, echo: 0},
+		{name: "normal", frame: closeFrame(CloseNormalClosure, "bye"), code: CloseNormalClosure, reason: "bye", echo: CloseNormalClosure},
+		{name: "going away", frame: closeFrame(CloseGoingAway, ""), code: CloseGoingAway, echo: CloseGoingAway},
+		{name: "registered 1014", frame: closeFrame(1014, ""), code: 1014, echo: 1014},
+		{name: "library code", frame: closeFrame(3000, ""), code: 3000, echo: 3000},
+		{name: "application code", frame: closeFrame(4999, "app"), code: 4999, reason: "app", echo: 4999},
+		{name: "one byte payload", frame: frame(0x88, "\x03"), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "invalid utf-8 reason", frame: closeFrame(CloseNormalClosure, "\xff"), code: CloseInvalidPayload, echo: CloseInvalidPayload},
+		{name: "below 1000", frame: closeFrame(999, ""), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "reserved 1004", frame: closeFrame(1004, ""), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "local only 1005", frame: closeFrame(CloseNoStatus, ""), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "local only 1006", frame: closeFrame(CloseAbnormal, ""), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "local only 1015", frame: closeFrame(1015, ""), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "unassigned 2999", frame: closeFrame(2999, ""), code: CloseProtocolError, echo: CloseProtocolError},
+		{name: "above 4999", frame: closeFrame(5000, ""), code: CloseProtocolError, echo: CloseProtocolError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := pipe(t)
+			if _, err := client.c.Write(tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := server.ReadMessage()
+			var ce *CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("err = %v, want a CloseError", err)
+			}
+			if ce.Code != tt.code || ce.Reason != tt.reason {
+				t.Fatalf("got %d %q, want %d %q", ce.Code, ce.Reason, tt.code, tt.reason)
+			}
+
+			hdr, payload, err := client.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.opcode != opClose {
+				t.Fatalf("answered with opcode %#x", hdr.opcode)
+			}
+			echo := 0
+			if len(payload) >= 2 {
+				echo = int(binary.BigEndian.Uint16(payload))
+			}
+			if echo != tt.echo || len(payload) > 2 {
+				t.Fatalf("echoed % x, want code %d", payload, tt.echo)
+			}
+			if err := server.WriteText([]byte("late")); !errors.Is(err, ErrCloseSent) {
+				t.Fatalf("write after close = %v, want ErrCloseSent", err)
+			}
+		})
+	}
+}
+
+func TestCloseWithStatus(t *testing.T) {
+	server, client := pipe(t)
+	// the server's read loop observes the client's reply
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		read <- err
+	}()
+
+	reason := strings.Repeat("é", 100)
+	done := make(chan error, 1)
+	go func() { done <- server.CloseWithStatus(4001, reason, 5*time.Second) }()
+
+	_, _, err := client.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != 4001 {
+		t.Fatalf("client read %v, want close 4001", err)
+	}
+	// the reason is cut to fit a control frame, on a rune boundary
+	if len(ce.Reason) > maxCloseReason || !strings.HasPrefix(reason, ce.Reason) {
+		t.Fatalf("reason %q (%d bytes) is not a prefix within %d bytes", ce.Reason, len(ce.Reason), maxCloseReason)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseWithStatus did not return after the client answered")
+	}
+	if err := <-read; CloseCode(err) != 4001 {
+		t.Fatalf("server read %v, want the echoed 4001", err)
+	}
+}
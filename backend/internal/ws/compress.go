@@ -0,0 +1,212 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// minCompressSize skips compression for messages where the deflate framing
+// would cost about as much as it saves.
+const minCompressSize = 64
+
+const maxWindowSize = 1 << 15
+
+// deflateTail is the sync flush marker stripped from every compressed message
+// (RFC 7692 section 7.2.1) followed by an empty final block so the inflater
+// stops cleanly at the end of a message.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// CompressionOptions configures the permessage-deflate extension.
+type CompressionOptions struct {
+	Enabled bool
+	// Level is a compress/flate level; zero means flate.BestSpeed.
+	Level int
+	// ServerNoContextTakeover resets the server's compressor after every
+	// message. Connections then borrow a compressor from a shared pool for
+	// each message instead of keeping one (several hundred KB) each, trading
+	// ratio for memory.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover asks the client to do the same.
+	ClientNoContextTakeover bool
+}
+
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+func (p deflateParams) responseHeader() string {
+	h := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		h += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		h += "; client_no_context_takeover"
+	}
+	return h
+}
+
+// negotiateDeflate picks the first permessage-deflate offer we can honour.
+// Offers that limit the server window below 32KB are skipped because
+// compress/flate always uses the full window.
+func negotiateDeflate(h http.Header, opts CompressionOptions) (deflateParams, bool) {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+	offers:
+		for _, offer := range strings.Split(v, ",") {
+			parts := strings.Split(offer, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), "permessage-deflate") {
+				continue
+			}
+			p := deflateParams{
+				serverNoContextTakeover: opts.ServerNoContextTakeover,
+				clientNoContextTakeover: opts.ClientNoContextTakeover,
+			}
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "server_no_context_takeover":
+					p.serverNoContextTakeover = true
+				case "client_no_context_takeover":
+					p.clientNoContextTakeover = true
+				case "server_max_window_bits":
+					if value != "15" {
+						continue offers
+					}
+				case "client_max_window_bits":
+					// any client window fits in our 32KB inflate window
+				default:
+					continue offers
+				}
+			}
+			return p, true
+		}
+	}
+	return deflateParams{}, false
+}
+
+// flateWriters pools the compressors of connections without write context
+// takeover, one pool per compression level.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func getFlateWriter(w io.Writer, level int) (*flate.Writer, error) {
+	if level >= flate.HuffmanOnly && level <= flate.BestCompression {
+		if fw, ok := flateWriters[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+			fw.Reset(w)
+			return fw, nil
+		}
+	}
+	return flate.NewWriter(w, level)
+}
+
+func putFlateWriter(fw *flate.Writer, level int) {
+	// let go of the connection's buffer
+	fw.Reset(io.Discard)
+	flateWriters[level-flate.HuffmanOnly].Put(fw)
+}
+
+type deflateState struct {
+	level           int
+	writeNoTakeover bool
+	readNoTakeover  bool
+
+	// fw is kept between messages only with context takeover
+	fw   *flate.Writer
+	wbuf bytes.Buffer
+
+	fr   io.ReadCloser
+	dict []byte
+}
+
+func newDeflateState(p deflateParams, level int, server bool) *deflateState {
+	if level == 0 {
+		level = flate.BestSpeed
+	}
+	d := &deflateState{level: level}
+	if server {
+		d.writeNoTakeover = p.serverNoContextTakeover
+		d.readNoTakeover = p.clientNoContextTakeover
+	} else {
+		d.writeNoTakeover = p.clientNoContextTakeover
+		d.readNoTakeover = p.serverNoContextTakeover
+	}
+	return d
+}
+
+// compress returns the deflated payload. The result aliases internal
+// storage and is only valid until the next call.
+func (d *deflateState) compress(p []byte) ([]byte, error) {
+	d.wbuf.Reset()
+	if d.writeNoTakeover {
+		fw, err := getFlateWriter(&d.wbuf, d.level)
+		if err != nil {
+			return nil, err
+		}
+		defer putFlateWriter(fw, d.level)
+		return d.deflate(fw, p)
+	}
+	if d.fw == nil {
+		fw, err := flate.NewWriter(&d.wbuf, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.fw = fw
+	}
+	return d.deflate(d.fw, p)
+}
+
+func (d *deflateState) deflate(fw *flate.Writer, p []byte) ([]byte, error) {
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(d.wbuf.Bytes(), deflateTail[:4]), nil
+}
+
+func (d *deflateState) decompress(p []byte, limit int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail))
+	var dict []byte
+	if !d.readNoTakeover {
+		dict = d.dict
+	}
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(src, dict)
+	} else if err := d.fr.(flate.Resetter).Reset(src, dict); err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(io.LimitReader(d.fr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrMessageTooLarge
+	}
+
+	if !d.readNoTakeover {
+		d.dict = append(d.dict, out...)
+		if len(d.dict) > maxWindowSize {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-maxWindowSize:]...)
+		}
+	}
+	return out, nil
+}
+
+// CompressionNegotiated reports whether permessage-deflate is active.
+func (c *Conn) CompressionNegotiated() bool {
+	return c.deflate != nil
+}
+
+// EnableWriteCompression turns compression of outgoing messages on or off.
+// It is a no-op when the extension was not negotiated.
+func (c *Conn) EnableWriteCompression(on bool) {
+	c.writeMu.Lock()
+	c.compressWrite = on && c.deflate != nil
+	c.writeMu.Unlock()
+}
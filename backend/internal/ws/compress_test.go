@@ -0,0 +1,148 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// deflatePipe is pipe with permessage-deflate negotiated as p.
+func deflatePipe(t *testing.T, p deflateParams) (server, client *Conn) {
+	server, client = pipe(t)
+	server.deflate = newDeflateState(p, 0, true)
+	client.deflate = newDeflateState(p, 0, false)
+	server.EnableWriteCompression(true)
+	client.EnableWriteCompression(true)
+	return server, client
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	msgs := [][]byte{
+		[]byte(`{"type":"game_state","payload":{"tick":1,"players":[{"id":"u_a","x":2.5,"y":2.5}]}}`),
+		[]byte(`{"type":"game_state","payload":{"tick":2,"players":[{"id":"u_a","x":2.6,"y":2.5}]}}`),
+		// too short to be compressed
+		[]byte(`{"type":"pong"}`),
+		bytes.Repeat([]byte("0123456789abcdef"), 8192),
+		[]byte(`{"type":"game_state","payload":{"tick":3,"players":[{"id":"u_a","x":2.7,"y":2.5}]}}`),
+	}
+	for _, p := range []deflateParams{
+		{},
+		{serverNoContextTakeover: true},
+		{clientNoContextTakeover: true},
+		{serverNoContextTakeover: true, clientNoContextTakeover: true},
+	} {
+		p := p
+		t.Run(p.responseHeader(), func(t *testing.T) {
+			server, client := deflatePipe(t, p)
+			for _, dir := range []string{"server to client", "client to server"} {
+				from, to := server, client
+				if dir == "client to server" {
+					from, to = client, server
+				}
+				for i, msg := range msgs {
+					errc := make(chan error, 1)
+					go func() { errc <- from.WriteText(msg) }()
+					_, got, err := to.ReadMessage()
+					if err != nil {
+						t.Fatalf("%s, message %d: %v", dir, i, err)
+					}
+					if err := <-errc; err != nil {
+						t.Fatalf("%s, message %d: write: %v", dir, i, err)
+					}
+					if !bytes.Equal(got, msg) {
+						t.Fatalf("%s, message %d: got %d bytes, want %d", dir, i, len(got), len(msg))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDeflateContextTakeover(t *testing.T) {
+	msg := []byte(strings.Repeat(`{"type":"chat","payload":{"text":"hello there"}}`, 4))
+	for _, noTakeover := range []bool{false, true} {
+		d := newDeflateState(deflateParams{serverNoContextTakeover: noTakeover}, 0, true)
+		first, err := d.compress(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := len(first)
+		second, err := d.compress(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// with the previous message in the window the repeat is almost free
+		if shrank := len(second) < n; shrank == noTakeover {
+			t.Errorf("no context takeover %v: repeat compressed to %d bytes, first %d", noTakeover, len(second), n)
+		}
+	}
+}
+
+func TestDeflateTooLarge(t *testing.T) {
+	server, client := deflatePipe(t, deflateParams{})
+	server.SetMaxMessageSize(1000)
+	// a few bytes on the wire that inflate past the limit
+	if err := client.WriteText(bytes.Repeat([]byte{'a'}, 1001)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("err = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer string
+		opts  CompressionOptions
+		want  string
+	}{
+		{offer: "permessage-deflate", want: "permessage-deflate"},
+		{offer: "permessage-deflate; client_max_window_bits", want: "permessage-deflate"},
+		{offer: "permessage-deflate; server_no_context_takeover", want: "permessage-deflate; server_no_context_takeover"},
+		{
+			offer: "permessage-deflate",
+			opts:  CompressionOptions{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			want:  "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		},
+		{offer: "permessage-deflate; server_max_window_bits=10, permessage-deflate", want: "permessage-deflate"},
+		{offer: "permessage-deflate; server_max_window_bits=10"},
+		{offer: "permessage-deflate; unknown_param"},
+		{offer: "x-webkit-deflate-frame"},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Sec-Websocket-Extensions": {tt.offer}}
+		p, ok := negotiateDeflate(h, tt.opts)
+		got := ""
+		if ok {
+			got = p.responseHeader()
+		}
+		if got != tt.want {
+			t.Errorf("%q with %+v: got %q, want %q", tt.offer, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestFlateWriterPool(t *testing.T) {
+	// borrowed writers must not carry state from one connection to the next
+	a := newDeflateState(deflateParams{serverNoContextTakeover: true}, 0, true)
+	b := newDeflateState(deflateParams{serverNoContextTakeover: true}, 0, true)
+	r := newDeflateState(deflateParams{serverNoContextTakeover: true}, 0, false)
+	for i := 0; i < 20; i++ {
+		d := a
+		if i%2 == 1 {
+			d = b
+		}
+		msg := []byte(fmt.Sprintf("message %d %s", i, strings.Repeat("x", i*10)))
+		c, err := d.compress(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.decompress(append([]byte(nil), c...), 1<<20)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("message %d: got %q, %v", i, got, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package ws
+
+import (
+	"errors"
+	"time"
+)
+
+// SetIdleTimeout makes reads fail once no frame at all (data, ping or pong)
+// has arrived for d. Zero disables the timeout. Call before reading.
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
+}
+
+// SetWriteTimeout bounds how long a single frame write may block. Zero
+// disables the timeout.
+func (c *Conn) SetWriteTimeout(d time.Duration) {
+	c.writeMu.Lock()
+	c.writeTimeout = d
+	c.writeMu.Unlock()
+}
+
+// SetPongHandler registers a callback run by the reading goroutine for
+// every pong frame. Call before reading.
+func (c *Conn) SetPongHandler(h func(appData []byte)) {
+	c.pongHandler = h
+}
+
+// WritePing sends a ping control frame; the payload is at most 125 bytes.
+func (c *Conn) WritePing(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("ws: ping payload too long")
+	}
+	return c.writeFrame(opPing, data)
+}
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
@@ -9,39 +10,139 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// DefaultMaxMessageSize bounds a reassembled message unless SetMaxMessageSize is called.
+const DefaultMaxMessageSize = 1 << 20
+
+var (
+	ErrMessageTooLarge = errors.New("ws: message too large")
+	ErrProtocol        = errors.New("ws: protocol error")
+)
+
 type Conn struct {
 	c  net.Conn
 	br *bufio.Reader
 	bw *bufio.Writer
 
-	writeMu sync.Mutex
+	// client is set for connections created by Dial: outgoing frames are
+	// masked and incoming ones must not be
+	client bool
+
+	maxMessageSize int
+	subprotocol    string
+
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	pongHandler  func(appData []byte)
+
+	// permessage-deflate state, nil when the extension was not negotiated
+	deflate       *deflateState
+	compressWrite bool
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	closeOnce sync.Once
+	closeRecv chan struct{}
+}
+
+// Upgrader holds the server side handshake options.
+type Upgrader struct {
+	// AllowedOrigins restricts the Origin header of browser clients.
+	// Entries are matched with path.Match against the full origin
+	// ("https://*.example.com", "http://localhost:*") or, when they have no
+	// scheme, against the host alone. An empty list accepts any origin.
+	// Requests without an Origin header (non-browser clients) are accepted.
+	AllowedOrigins []string
+
+	// Subprotocols lists the supported Sec-WebSocket-Protocol values in
+	// order of preference. The first one the client also offers is selected.
+	Subprotocols []string
+
+	// CheckRequest runs after the protocol checks and before the
+	// connection is hijacked. Returning a *HandshakeError rejects the
+	// request with its status; any other error rejects with 403.
+	CheckRequest func(r *http.Request) error
+
+	// Compression controls permessage-deflate negotiation.
+	Compression CompressionOptions
+}
+
+// HandshakeError is returned by Upgrade when the request was refused. The
+// error response has already been written.
+type HandshakeError struct {
+	Status int
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("ws: handshake rejected (%d): %s", e.Status, e.Reason)
 }
 
 func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	return (&Upgrader{}).Upgrade(w, r)
+}
+
+// Upgrade performs the server handshake. When the request is rejected the
+// HTTP error response is written here and a *HandshakeError is returned.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 	if !headerContainsToken(r.Header, "Connection", "Upgrade") {
-		return nil, errors.New("missing Connection: Upgrade")
+		return nil, reject(w, http.StatusBadRequest, "missing Connection: Upgrade")
 	}
 	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
-		return nil, errors.New("missing Upgrade: websocket")
+		return nil, reject(w, http.StatusBadRequest, "missing Upgrade: websocket")
 	}
 	if r.Header.Get("Sec-WebSocket-Version") != "13" {
-		return nil, errors.New("unsupported websocket version")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, reject(w, http.StatusUpgradeRequired, "unsupported websocket version")
 	}
 	key := strings.TrimSpace(r.Header.Get("Sec-WebSocket-Key"))
 	if key == "" {
-		return nil, errors.New("missing Sec-WebSocket-Key")
+		return nil, reject(w, http.StatusBadRequest, "missing Sec-WebSocket-Key")
+	}
+	if !u.originAllowed(r.Header.Get("Origin")) {
+		return nil, reject(w, http.StatusForbidden, "origin not allowed")
+	}
+	if u.CheckRequest != nil {
+		if err := u.CheckRequest(r); err != nil {
+			var he *HandshakeError
+			if errors.As(err, &he) {
+				return nil, reject(w, he.Status, he.Reason)
+			}
+			return nil, reject(w, http.StatusForbidden, err.Error())
+		}
 	}
 	accept := computeAccept(key)
+	subprotocol := u.selectSubprotocol(r.Header)
+
+	var deflate *deflateState
+	var extHeader string
+	if u.Compression.Enabled {
+		if p, ok := negotiateDeflate(r.Header, u.Compression); ok {
+			deflate = newDeflateState(p, u.Compression.Level, true)
+			extHeader = p.responseHeader()
+		}
+	}
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		return nil, errors.New("hijacking not supported")
+		return nil, reject(w, http.StatusInternalServerError, "hijacking not supported")
 	}
 	netConn, buf, err := hj.Hijack()
 	if err != nil {
@@ -52,6 +153,12 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 	_, _ = fmt.Fprintf(buf, "Upgrade: websocket\r\n")
 	_, _ = fmt.Fprintf(buf, "Connection: Upgrade\r\n")
 	_, _ = fmt.Fprintf(buf, "Sec-WebSocket-Accept: %s\r\n", accept)
+	if subprotocol != "" {
+		_, _ = fmt.Fprintf(buf, "Sec-WebSocket-Protocol: %s\r\n", subprotocol)
+	}
+	if extHeader != "" {
+		_, _ = fmt.Fprintf(buf, "Sec-WebSocket-Extensions: %s\r\n", extHeader)
+	}
 	_, _ = fmt.Fprintf(buf, "\r\n")
 	if err := buf.Flush(); err != nil {
 		_ = netConn.Close()
@@ -59,12 +166,55 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 	}
 
 	return &Conn{
-		c:  netConn,
-		br: bufio.NewReader(netConn),
-		bw: bufio.NewWriter(netConn),
+		c:              netConn,
+		br:             bufio.NewReader(netConn),
+		bw:             bufio.NewWriter(netConn),
+		maxMessageSize: DefaultMaxMessageSize,
+		subprotocol:    subprotocol,
+		deflate:        deflate,
+		closeRecv:      make(chan struct{}),
 	}, nil
 }
 
+func reject(w http.ResponseWriter, status int, reason string) error {
+	http.Error(w, reason, status)
+	return &HandshakeError{Status: status, Reason: reason}
+}
+
+func (u *Upgrader) originAllowed(origin string) bool {
+	if origin == "" || len(u.AllowedOrigins) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	host := origin
+	if i := strings.Index(origin, "://"); i >= 0 {
+		host = origin[i+3:]
+	}
+	for _, pattern := range u.AllowedOrigins {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" {
+			return true
+		}
+		target := origin
+		if !strings.Contains(pattern, "://") {
+			target = host
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Upgrader) selectSubprotocol(h http.Header) string {
+	for _, want := range u.Subprotocols {
+		if headerContainsToken(h, "Sec-WebSocket-Protocol", want) {
+			return want
+		}
+	}
+	return ""
+}
+
 func computeAccept(key string) string {
 	h := sha1.New()
 	_, _ = io.WriteString(h, key)
@@ -84,71 +234,190 @@ func headerContainsToken(h http.Header, name, token string) bool {
 	return false
 }
 
+// Subprotocol returns the negotiated Sec-WebSocket-Protocol, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
 func (c *Conn) Close() error {
 	return c.c.Close()
 }
 
+// SetMaxMessageSize limits the size of a message after all of its fragments
+// have been joined. Values <= 0 restore DefaultMaxMessageSize.
+func (c *Conn) SetMaxMessageSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxMessageSize
+	}
+	c.maxMessageSize = n
+}
+
+// Message types returned by ReadMessage and accepted by WriteMessage.
+const (
+	TextMessage   = int(opText)
+	BinaryMessage = int(opBinary)
+)
+
+// ReadText returns the next text message, discarding binary ones.
 func (c *Conn) ReadText() ([]byte, error) {
 	for {
-		op, payload, err := c.readFrame()
+		op, msg, err := c.readMessage()
 		if err != nil {
 			return nil, err
 		}
-		switch op {
-		case 0x1:
-			return payload, nil
-		case 0x8:
-			return nil, io.EOF
-		case 0x9:
-			_ = c.writeFrame(0xA, payload)
-		case 0xA:
-		default:
+		if op == opText {
+			return msg, nil
 		}
 	}
 }
 
+// ReadMessage returns the next data message and its type.
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	op, msg, err := c.readMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(op), msg, nil
+}
+
 func (c *Conn) WriteText(b []byte) error {
-	return c.writeFrame(0x1, b)
+	return c.writeData(opText, b)
+}
+
+func (c *Conn) WriteBinary(b []byte) error {
+	return c.writeData(opBinary, b)
+}
+
+func (c *Conn) WriteMessage(messageType int, b []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+		return c.writeData(byte(messageType), b)
+	default:
+		return fmt.Errorf("ws: unsupported message type %d", messageType)
+	}
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
 }
 
-func (c *Conn) readFrame() (opcode byte, payload []byte, err error) {
+// readMessage returns the next complete data message. Fragments are joined
+// in order and control frames arriving between them are handled inline.
+func (c *Conn) readMessage() (opcode byte, msg []byte, err error) {
+	inMessage := false
+	compressed := false
+	for {
+		hdr, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch hdr.opcode {
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opPing:
+			_ = c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(payload)
+			}
+			continue
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, fmt.Errorf("%w: unexpected continuation frame", ErrProtocol)
+			}
+			if hdr.rsv1 {
+				return 0, nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+			}
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, fmt.Errorf("%w: expected continuation frame", ErrProtocol)
+			}
+			inMessage = true
+			opcode = hdr.opcode
+			compressed = hdr.rsv1
+		default:
+			return 0, nil, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, hdr.opcode)
+		}
+
+		if len(msg)+len(payload) > c.maxMessageSize {
+			return 0, nil, ErrMessageTooLarge
+		}
+		msg = append(msg, payload...)
+		if hdr.fin {
+			break
+		}
+	}
+
+	if compressed {
+		msg, err = c.deflate.decompress(msg, c.maxMessageSize)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return opcode, msg, nil
+}
+
+func (c *Conn) readFrame() (hdr frameHeader, payload []byte, err error) {
+	if c.idleTimeout > 0 {
+		_ = c.c.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
 	b0, err := c.br.ReadByte()
 	if err != nil {
-		return 0, nil, err
+		return hdr, nil, err
 	}
 	b1, err := c.br.ReadByte()
 	if err != nil {
-		return 0, nil, err
+		return hdr, nil, err
 	}
 
-	fin := (b0 & 0x80) != 0
-	opcode = b0 & 0x0F
-	if !fin {
-		return 0, nil, errors.New("fragmented frames not supported")
+	hdr.fin = (b0 & 0x80) != 0
+	hdr.rsv1 = (b0 & 0x40) != 0
+	hdr.opcode = b0 & 0x0F
+	control := hdr.opcode&0x8 != 0
+	if b0&0x30 != 0 || (hdr.rsv1 && (c.deflate == nil || control)) {
+		return hdr, nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	if control && !hdr.fin {
+		return hdr, nil, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
 	}
 
 	masked := (b1 & 0x80) != 0
-	if !masked {
-		return 0, nil, errors.New("client frames must be masked")
+	if !masked && !c.client {
+		return hdr, nil, errors.New("client frames must be masked")
+	}
+	if masked && c.client {
+		return hdr, nil, fmt.Errorf("%w: server frames must not be masked", ErrProtocol)
 	}
 	length7 := int(b1 & 0x7F)
+	if control && length7 > 125 {
+		return hdr, nil, fmt.Errorf("%w: control frame too long", ErrProtocol)
+	}
 	length, err := c.readLength(length7)
 	if err != nil {
-		return 0, nil, err
+		return hdr, nil, err
+	}
+	if length > c.maxMessageSize {
+		return hdr, nil, ErrMessageTooLarge
 	}
 
 	var maskKey [4]byte
-	if _, err := io.ReadFull(c.br, maskKey[:]); err != nil {
-		return 0, nil, err
+	if masked {
+		if _, err := io.ReadFull(c.br, maskKey[:]); err != nil {
+			return hdr, nil, err
+		}
 	}
 	payload = make([]byte, length)
 	if _, err := io.ReadFull(c.br, payload); err != nil {
-		return 0, nil, err
+		return hdr, nil, err
 	}
-	for i := 0; i < length; i++ {
-		payload[i] ^= maskKey[i%4]
+	if masked {
+		maskBytes(maskKey, payload)
 	}
-	return opcode, payload, nil
+	return hdr, payload, nil
 }
 
 func (c *Conn) readLength(length7 int) (int, error) {
@@ -168,8 +437,8 @@ func (c *Conn) readLength(length7 int) (int, error) {
 		for i := 0; i < 8; i++ {
 			n = (n << 8) | int(b[i])
 		}
-		if n < 0 || n > 1<<20 {
-			return 0, errors.New("payload too large")
+		if n < 0 {
+			return 0, ErrMessageTooLarge
 		}
 		return n, nil
 	default:
@@ -177,23 +446,62 @@ func (c *Conn) readLength(length7 int) (int, error) {
 	}
 }
 
+// writeData writes a data message, compressing it when permessage-deflate
+// is active for writes and the message is big enough to benefit.
+func (c *Conn) writeData(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	b0 := 0x80 | opcode
+	if c.compressWrite && len(payload) >= minCompressSize {
+		out, err := c.deflate.compress(payload)
+		if err != nil {
+			return err
+		}
+		payload = out
+		b0 |= 0x40
+	}
+	return c.writeFrameLocked(b0, payload)
+}
+
 func (c *Conn) writeFrame(opcode byte, payload []byte) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
-	b0 := byte(0x80) | (opcode & 0x0F)
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrameLocked(0x80|(opcode&0x0F), payload)
+}
+
+func (c *Conn) writeFrameLocked(b0 byte, payload []byte) error {
+	if c.writeTimeout > 0 {
+		_ = c.c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
 	if err := c.bw.WriteByte(b0); err != nil {
 		return err
 	}
 
+	// frames sent by a client must be masked (RFC 6455 section 5.3)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
 	n := len(payload)
 	switch {
 	case n < 126:
-		if err := c.bw.WriteByte(byte(n)); err != nil {
+		if err := c.bw.WriteByte(maskBit | byte(n)); err != nil {
 			return err
 		}
 	case n <= 0xFFFF:
-		if err := c.bw.WriteByte(126); err != nil {
+		if err := c.bw.WriteByte(maskBit | 126); err != nil {
 			return err
 		}
 		if err := c.bw.WriteByte(byte(n >> 8)); err != nil {
@@ -203,7 +511,7 @@ func (c *Conn) writeFrame(opcode byte, payload []byte) error {
 			return err
 		}
 	default:
-		if err := c.bw.WriteByte(127); err != nil {
+		if err := c.bw.WriteByte(maskBit | 127); err != nil {
 			return err
 		}
 		var b [8]byte
@@ -217,9 +525,29 @@ func (c *Conn) writeFrame(opcode byte, payload []byte) error {
 		}
 	}
 
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		if _, err := c.bw.Write(key[:]); err != nil {
+			return err
+		}
+		masked := make([]byte, n)
+		copy(masked, payload)
+		maskBytes(key, masked)
+		payload = masked
+	}
+
 	if _, err := c.bw.Write(payload); err != nil {
 		return err
 	}
 	return c.bw.Flush()
 }
 
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
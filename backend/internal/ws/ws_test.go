@@ -0,0 +1,181 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newConn(nc net.Conn, client bool) *Conn {
+	return &Conn{
+		c:              nc,
+		br:             bufio.NewReader(nc),
+		bw:             bufio.NewWriter(nc),
+		client:         client,
+		maxMessageSize: DefaultMaxMessageSize,
+		closeRecv:      make(chan struct{}),
+	}
+}
+
+// pipe connects a server side Conn to a client side one over loopback TCP,
+// which unlike net.Pipe buffers writes nobody is reading yet.
+func pipe(t *testing.T) (server, client *Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+	})
+	server, client = newConn(sc, false), newConn(cc, true)
+	server.SetIdleTimeout(5 * time.Second)
+	client.SetIdleTimeout(5 * time.Second)
+	return server, client
+}
+
+// frame encodes a masked frame as a client sends it; b0 holds FIN, the
+// reserved bits and the opcode.
+func frame(b0 byte, payload string) []byte {
+	b := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 0x80|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x80|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	p := []byte(payload)
+	maskBytes(key, p)
+	return append(append(b, key[:]...), p...)
+}
+
+func TestReadMessage(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		max    int
+		op     int
+		msg    string
+		pongs  []string
+		err    error
+	}{
+		{name: "text", frames: [][]byte{frame(0x81, "hello")}, op: TextMessage, msg: "hello"},
+		{name: "binary", frames: [][]byte{frame(0x82, "\x00\x01")}, op: BinaryMessage, msg: "\x00\x01"},
+		{name: "16 bit length", frames: [][]byte{frame(0x81, long)}, op: TextMessage, msg: long},
+		{name: "empty", frames: [][]byte{frame(0x81, "")}, op: TextMessage, msg: ""},
+		{
+			name:   "fragments",
+			frames: [][]byte{frame(0x01, "hel"), frame(0x00, "lo"), frame(0x80, " world")},
+			op:     TextMessage, msg: "hello world",
+		},
+		{
+			name:   "ping between fragments",
+			frames: [][]byte{frame(0x02, "ab"), frame(0x89, "p1"), frame(0x00, "cd"), frame(0x89, "p2"), frame(0x80, "ef")},
+			op:     BinaryMessage, msg: "abcdef", pongs: []string{"p1", "p2"},
+		},
+		{
+			name:   "pong between fragments",
+			frames: [][]byte{frame(0x01, "ab"), frame(0x8A, "late"), frame(0x80, "cd")},
+			op:     TextMessage, msg: "abcd",
+		},
+		{name: "exactly max size", frames: [][]byte{frame(0x81, "0123456789")}, max: 10, op: TextMessage, msg: "0123456789"},
+		{name: "frame over max size", frames: [][]byte{frame(0x81, "0123456789a")}, max: 10, err: ErrMessageTooLarge},
+		{name: "fragments over max size", frames: [][]byte{frame(0x01, "012345"), frame(0x80, "6789a")}, max: 10, err: ErrMessageTooLarge},
+		{name: "fragmented ping", frames: [][]byte{frame(0x09, "p")}, err: ErrProtocol},
+		{name: "fragmented close", frames: [][]byte{frame(0x08, "")}, err: ErrProtocol},
+		{name: "oversized ping", frames: [][]byte{frame(0x89, strings.Repeat("p", 126))}, err: ErrProtocol},
+		{name: "oversized close", frames: [][]byte{frame(0x88, "\x03\xe8"+strings.Repeat("r", 124))}, err: ErrProtocol},
+		{name: "continuation first", frames: [][]byte{frame(0x80, "x")}, err: ErrProtocol},
+		{name: "new message between fragments", frames: [][]byte{frame(0x01, "a"), frame(0x81, "b")}, err: ErrProtocol},
+		{name: "reserved bit without extension", frames: [][]byte{frame(0xC1, "x")}, err: ErrProtocol},
+		{name: "unknown opcode", frames: [][]byte{frame(0x83, "x")}, err: ErrProtocol},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := pipe(t)
+			server.SetMaxMessageSize(tt.max)
+			for _, f := range tt.frames {
+				if _, err := client.c.Write(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			op, msg, err := server.ReadMessage()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if op != tt.op || string(msg) != tt.msg {
+				t.Fatalf("got %d %q, want %d %q", op, msg, tt.op, tt.msg)
+			}
+			for _, want := range tt.pongs {
+				hdr, payload, err := client.readFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.opcode != opPong || string(payload) != want {
+					t.Fatalf("got opcode %#x %q, want pong %q", hdr.opcode, payload, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		msg := bytes.Repeat([]byte{'m'}, n)
+		for _, dir := range []string{"server to client", "client to server"} {
+			server, client := pipe(t)
+			from, to := server, client
+			if dir == "client to server" {
+				from, to = client, server
+			}
+			errc := make(chan error, 1)
+			go func() { errc <- from.WriteBinary(msg) }()
+			op, got, err := to.ReadMessage()
+			if err != nil {
+				t.Fatalf("%d bytes %s: %v", n, dir, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("%d bytes %s: write: %v", n, dir, err)
+			}
+			if op != BinaryMessage || !bytes.Equal(got, msg) {
+				t.Fatalf("%d bytes %s: got %d, %d bytes", n, dir, op, len(got))
+			}
+		}
+	}
+}
+
+func TestUnmaskedClientFrame(t *testing.T) {
+	server, client := pipe(t)
+	// what a server would send: no mask
+	if _, err := client.c.Write([]byte{0x81, 0x02, 'h', 'i'}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.ReadMessage(); err == nil {
+		t.Fatal("unmasked frame from a client accepted")
+	}
+}
@@ -12,6 +12,7 @@ import (
 func main() {
 	addr := flag.String("addr", ":5173", "http listen address")
 	wsURL := flag.String("ws", "ws://localhost:8080/ws", "backend websocket url")
+	replayURL := flag.String("replay-ws", "ws://localhost:8081/replay", "replay server (backend cmd/replay) websocket url")
 	flag.Parse()
 
 	webDir := filepath.Join(".", "web")
@@ -23,7 +24,7 @@ func main() {
 	})
 	mux.HandleFunc("/config.js", func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
-		_, _ = fmt.Fprintf(w, "window.__CONFIG__ = %s;\n", fmt.Sprintf(`{"wsUrl":%q}`, *wsURL))
+		_, _ = fmt.Fprintf(w, "window.__CONFIG__ = %s;\n", fmt.Sprintf(`{"wsUrl":%q,"replayUrl":%q}`, *wsURL, *replayURL))
 	})
 	mux.Handle("/", http.FileServer(http.Dir(webDir)))
 
@@ -35,6 +35,12 @@ const copyRoomIdBtn = qs("copyRoomIdBtn");
 const copyInviteBtn = qs("copyInviteBtn");
 const winScoreInput = qs("winScoreInput");
 const showEnemiesOnMapToggle = qs("showEnemiesOnMapToggle");
+const maxPlayersInput = qs("maxPlayersInput");
+const privateToggle = qs("privateToggle");
+const roomPasswordInput = qs("roomPasswordInput");
+const roomPrivateToggle = qs("roomPrivateToggle");
+const allowLateJoinToggle = qs("allowLateJoinToggle");
+const allowSpectatorsToggle = qs("allowSpectatorsToggle");
 const wallTextInput = qs("wallTextInput");
 
 const gameCanvas = qs("gameCanvas");
@@ -65,16 +71,32 @@ const gameOverTitle = qs("gameOverTitle");
 const gameOverSub = qs("gameOverSub");
 const gameOverBless = qs("gameOverBless");
 const gameOverRank = qs("gameOverRank");
+const gameOverRematchBtn = qs("gameOverRematchBtn");
 const gameOverLeaveBtn = qs("gameOverLeaveBtn");
+const gameOverReplayBtn = qs("gameOverReplayBtn");
 const gameOverCloseBtn = qs("gameOverCloseBtn");
 
+// @BE: message protocol spoken by this bundle (backend protocol.go)
+const PROTOCOL_VERSION = 2;
+const PROTOCOL_CAPS = ["resume", "delta.v1"];
+
 const app = {
   // @BE: WebSocket connection state (frontend <-> backend)
   ws: null,
   wsUrl: (__CONFIG__ && __CONFIG__.wsUrl) || "ws://localhost:8080/ws",
+  // @BE: replay server (backend cmd/replay), see startReplay
+  replayUrl: (__CONFIG__ && __CONFIG__.replayUrl) || "ws://localhost:8081/replay",
+  // set while watching a recording: { id, speed, paused, tick, ticks }
+  replay: null,
 
   userId: "",
   name: "",
+  resumeToken: "",
+  protocol: 0,
+  resume: {
+    attempts: 0,
+    timer: null,
+  },
 
   rooms: [],
   room: null,
@@ -91,6 +113,14 @@ const app = {
     turnAccum: 0,
     shootEdge: false,
   },
+  // @BE: delta.v1 baselines: server snapshots by tick (as received, without prediction)
+  snaps: new Map(),
+  snapAck: 0,
+  // client-side prediction: inputs sent but not yet acked by a game_state
+  predict: {
+    seq: 0,
+    pending: [],
+  },
 
   sendTimer: null,
   raf: 0,
@@ -116,6 +146,10 @@ const app = {
     pingMs: 0,
     pingTimer: null,
   },
+  // spectators follow one of the players, see spectateTarget
+  spectate: {
+    targetId: "",
+  },
   match: {
     winScore: 10,
     showEnemiesOnMap: true,
@@ -128,6 +162,10 @@ const app = {
   roomDraft: {
     winScore: 10,
     showEnemiesOnMap: true,
+    maxPlayers: 8,
+    private: false,
+    allowLateJoin: false,
+    allowSpectators: false,
     wallText: "",
     dirty: false,
     timer: null,
@@ -154,10 +192,66 @@ function send(type, payload) {
   app.ws.send(JSON.stringify({ type, payload }));
 }
 
+const pendingRequests = new Map();
+let nextRequestId = 0;
+
+function request(type, payload) {
+  // @BE: like send, but with a request id; the backend echoes it on the reply/error
+  if (!app.ws || app.ws.readyState !== WebSocket.OPEN) return;
+  const id = String(++nextRequestId);
+  pendingRequests.set(id, { type, payload });
+  if (pendingRequests.size > 32) {
+    // requests that succeed without a direct reply (room_ready, chat_send, ...)
+    pendingRequests.delete(pendingRequests.keys().next().value);
+  }
+  app.ws.send(JSON.stringify({ type, id, payload }));
+}
+
+const REQUEST_TEXT = {
+  hello: "登录",
+  resume: "重连",
+  room_create: "创建房间",
+  room_join: "加入房间",
+  room_ready: "准备",
+  room_start: "开始游戏",
+  room_config: "修改房间设置",
+  room_rematch: "再来一局",
+  room_kick: "踢出玩家",
+  room_ban: "封禁玩家",
+  room_transfer_host: "转让房主",
+  chat_send: "发送消息",
+};
+
+const ERROR_TEXT = {
+  // @BE: error codes, see backend errors.go
+  name_required: "请输入昵称",
+  server_shutting_down: "服务器正在维护",
+  already_in_room: "你已经在房间里了",
+  room_not_found: "房间不存在",
+  not_in_room: "你不在房间里",
+  room_started: "对局已经开始",
+  not_host: "只有房主可以操作",
+  not_ready: "还有玩家没有准备",
+  spectators_disabled: "该房间不允许观战",
+  room_full: "房间已满",
+  wrong_password: "房间密码错误",
+  banned: "你已被该房间封禁",
+  player_not_found: "该玩家已不在房间里",
+  rate_limited: "操作太频繁，请稍后再试",
+  muted: "发言过于频繁，暂时被禁言",
+};
+
+function errorText(payload, reqType) {
+  const what = ERROR_TEXT[payload.code] || payload.message || "error";
+  const action = REQUEST_TEXT[reqType];
+  return action ? `${action}失败：${what}` : what;
+}
+
 function parseParams() {
   const p = new URLSearchParams(location.search);
   return {
     room: (p.get("room") || "").trim(),
+    replay: (p.get("replay") || "").trim(),
   };
 }
 
@@ -223,6 +317,20 @@ async function copyText(text) {
 
 function connectAndHello(name) {
   // @BE: establish WS and login by sending `hello`
+  openSocket(() => {
+    request("hello", { name, version: PROTOCOL_VERSION, caps: PROTOCOL_CAPS }); // @BE
+    send("rooms_list", {}); // @BE
+  });
+}
+
+function connectAndResume() {
+  // @BE: reconnect and take over the previous session (same userId, room slot and score)
+  openSocket(() => {
+    request("resume", { token: app.resumeToken, version: PROTOCOL_VERSION, caps: PROTOCOL_CAPS }); // @BE
+  });
+}
+
+function openSocket(onOpen) {
   if (app.ws) {
     try {
       app.ws.close();
@@ -234,36 +342,76 @@ function connectAndHello(name) {
   app.net.pingMs = 0;
 
   setNetStatus("连接中…");
-  app.ws = new WebSocket(app.wsUrl); // @BE: connect to backend /ws
-  app.ws.onopen = () => {
+  const sock = new WebSocket(app.wsUrl, ["fps.v1"]); // @BE: connect to backend /ws (subprotocol = protocol version)
+  app.ws = sock;
+  sock.onopen = () => {
     setNetStatus("已连接");
-    send("hello", { name }); // @BE
-    send("rooms_list", {}); // @BE
+    onOpen();
 
     app.net.pingTimer = setInterval(() => {
       send("ping", { t: Date.now() }); // @BE: app-level ping/pong RTT
     }, 1000);
   };
-  app.ws.onclose = () => {
-    setNetStatus("已断开");
+  sock.onclose = (ev) => {
+    if (app.ws !== sock) return; // replaced by a newer socket
     stopGameLoops();
     if (app.net.pingTimer) clearInterval(app.net.pingTimer);
     app.net.pingTimer = null;
+    if (shouldResume(ev.code)) {
+      // dropped mid-match: the backend keeps our slot for a while
+      app.resume.attempts++;
+      setNetStatus(`重连中…（${app.resume.attempts}）`);
+      app.resume.timer = setTimeout(connectAndResume, 1000 * app.resume.attempts);
+      return;
+    }
+    const why = closeReasonText(ev.code);
+    setNetStatus(why ? `已断开（${why}）` : "已断开");
+    if (why) alert(why);
     if (app.room) {
       app.room = null;
       showScreen(screenLobby);
     }
   };
-  app.ws.onerror = () => {
+  sock.onerror = () => {
     setNetStatus("连接错误");
   };
-  app.ws.onmessage = (ev) => {
+  sock.onmessage = (ev) => {
     const msg = safeJSON(ev.data);
     if (!msg) return;
     onMessage(msg); // @BE: dispatch backend messages
   };
 }
 
+function shouldResume(code) {
+  if (!app.resumeToken || !app.room || !app.room.started) return false;
+  if (code === 1000 || code === 4000 || code === 4001 || code === 4003 || code === 4004) return false;
+  return app.resume.attempts < 5;
+}
+
+function closeReasonText(code) {
+  // @BE: close codes used by backend Hub (see hub.go)
+  switch (code) {
+    case 4000:
+      return "你因长时间未操作已被服务器踢出";
+    case 4001:
+      return "账号已在其它页面重连";
+    case 4002:
+      return "网络太慢，跟不上服务器";
+    case 4003:
+      return "客户端版本与服务器不兼容，请刷新页面";
+    case 4004:
+      return "操作过于频繁，已被断开连接";
+    case 1001:
+      return "服务器正在维护";
+    case 1002:
+      return "协议错误";
+    case 1009:
+      return "消息过大";
+    default:
+      return "";
+  }
+}
+
 function safeJSON(s) {
   try {
     return JSON.parse(s);
@@ -274,10 +422,19 @@ function safeJSON(s) {
 
 function onMessage(env) {
   // @BE: receive message from backend, switch by `env.type`
+  let reqType = "";
+  let reqPayload = null;
+  if (env.id && pendingRequests.has(env.id)) {
+    ({ type: reqType, payload: reqPayload } = pendingRequests.get(env.id));
+    pendingRequests.delete(env.id);
+  }
   switch (env.type) {
     case "hello_ack":
       app.userId = env.payload.userId;
       app.name = env.payload.name;
+      app.resumeToken = env.payload.resumeToken || "";
+      app.protocol = env.payload.version || 1;
+      app.resume.attempts = 0;
       userPill.textContent = `${app.name} · ${app.userId}`;
       userPill.classList.remove("hidden");
       profileName.textContent = app.name;
@@ -285,7 +442,7 @@ function onMessage(env) {
       setAvatarTheme(profileAvatar, app.userId);
       showScreen(screenLobby);
       if (app.pendingRoomJoin) {
-        send("room_join", { roomId: app.pendingRoomJoin }); // @BE
+        request("room_join", { roomId: app.pendingRoomJoin }); // @BE
         app.pendingRoomJoin = "";
       }
       break;
@@ -293,15 +450,22 @@ function onMessage(env) {
       app.rooms = env.payload.rooms || [];
       renderRooms();
       break;
-    case "room_state":
+    case "room_state": {
+      const wasAfk = isAfk();
       app.room = env.payload;
       if (app.room && app.room.started) {
         showScreen(screenGame);
+        // @BE: flagged after a while without input, removed if it goes on
+        if (isAfk() && !wasAfk) toastMsg("你已被标记为挂机，继续不操作将被移出房间");
       } else {
+        // back from a finished match (rematch or the backend's auto-return timer)
+        stopGameLoops();
+        closeGameOver();
         showScreen(screenRoom);
       }
       renderRoom();
       break;
+    }
     case "game_start":
       app.map = env.payload.map;
       app.tickMs = env.payload.tickMs || 50;
@@ -316,6 +480,11 @@ function onMessage(env) {
       requestAnimationFrame(() => resizeCanvas());
       app.feed = [];
       app.prevFrameByID = new Map();
+      // @BE: input seq starts at 1 again for every game_start (the backend resets its ack)
+      app.predict = { seq: 0, pending: [] };
+      // @BE: deltas after game_start are against snapshots of this match only
+      app.snaps = new Map();
+      app.snapAck = 0;
       app.fx = {
         lastShotAt: 0,
         fireT: 0,
@@ -328,20 +497,64 @@ function onMessage(env) {
       showScreen(screenGame);
       break;
     case "game_state":
-      app.gameState = env.payload;
-      updateFxFromState();
+      // @BE: every tick without delta.v1, otherwise a keyframe (no names)
+      onSnapshot(env.payload);
+      break;
+    case "game_delta": {
+      // @BE: only what changed since the snapshot we acked as `base`
+      const base = app.snaps.get(env.payload.base);
+      if (base) onSnapshot(applyDelta(base, env.payload));
       break;
+    }
     case "chat":
       addChatLine(env.payload);
       break;
     case "pong":
       onPong(env.payload);
       break;
+    case "room_kicked":
+      // @BE: the host removed us from the room, or the backend did (reason "afk")
+      if (app.room && app.room.id === env.payload.roomId) {
+        leaveToLobby();
+        // an AFK kick is followed by close code 4000, which tells the user
+        if (env.payload.reason !== "afk") alert(env.payload.banned ? "你已被房主封禁，无法再加入该房间" : "你已被房主移出房间");
+      }
+      break;
+    case "room_closed":
+      // @BE: the last player left while we were spectating, or the room sat idle in the lobby
+      if (app.room && app.room.id === env.payload.roomId) {
+        leaveToLobby();
+        alert("房间已关闭");
+      }
+      break;
     case "game_over":
       onGameOver(env.payload);
       break;
+    case "server_shutdown":
+      onServerShutdown(env.payload);
+      break;
+    case "replay_info":
+      onReplayInfo(env.payload);
+      break;
     case "error":
-      alert(env.payload.message || "error");
+      if (env.payload.code === "resume_failed") {
+        // grace period is over: log in again as a fresh user
+        app.resumeToken = "";
+        app.room = null;
+        request("hello", { name: app.name, version: PROTOCOL_VERSION, caps: PROTOCOL_CAPS }); // @BE
+        send("rooms_list", {}); // @BE
+        break;
+      }
+      if (env.payload.code === "unsupported_version") {
+        // the close code 4003 that follows tells the user to reload
+        break;
+      }
+      if (env.payload.code === "wrong_password" && reqType === "room_join") {
+        const password = prompt(reqPayload.password ? "密码错误，请重新输入" : "该房间需要密码");
+        if (password !== null) request("room_join", { ...reqPayload, password }); // @BE
+        break;
+      }
+      alert(errorText(env.payload, reqType));
       break;
     default:
       break;
@@ -356,6 +569,15 @@ function onPong(payload) {
   app.net.pingMs = app.net.pingMs ? Math.round(app.net.pingMs * 0.8 + rtt * 0.2) : rtt;
 }
 
+function onServerShutdown(payload) {
+  // @BE: backend is draining; running matches end by `deadline` at the latest
+  const deadline = (payload && payload.deadline) || Date.now();
+  const secs = Math.max(0, Math.round((deadline - Date.now()) / 1000));
+  const text = `服务器即将维护（约 ${secs} 秒后）`;
+  setNetStatus(text);
+  toastMsg(text);
+}
+
 function onGameOver(payload) {
   // @BE: backend sent match result
   app.match.over = true;
@@ -380,15 +602,26 @@ function renderRooms() {
       const item = document.createElement("div");
       item.className = "roomItem";
       const left = document.createElement("div");
-      left.innerHTML = `<div>${escapeHTML(r.name)} ${r.started ? "（进行中）" : ""}</div>
-        <div class="meta">ID: ${escapeHTML(r.id)} ｜人数: ${r.players}</div>`;
+      left.innerHTML = `<div>${r.hasPassword ? "🔒 " : ""}${escapeHTML(r.name)} ${r.started ? "（进行中）" : ""}</div>
+        <div class="meta">ID: ${escapeHTML(r.id)} ｜人数: ${r.players}/${r.maxPlayers}${r.spectators ? ` ｜观战: ${r.spectators}` : ""}</div>`;
       const btn = document.createElement("button");
       btn.className = "btn primary";
-      btn.textContent = r.started ? "不可加入" : "加入";
-      btn.disabled = !!r.started;
-      btn.onclick = () => send("room_join", { roomId: r.id }); // @BE
+      const full = r.players >= r.maxPlayers;
+      const canJoin = (!r.started || r.allowLateJoin) && !full;
+      btn.textContent = canJoin ? "加入" : full ? "已满" : "不可加入";
+      btn.disabled = !canJoin;
+      btn.onclick = () => request("room_join", { roomId: r.id }); // @BE
       item.appendChild(left);
-      item.appendChild(btn);
+      const actions = document.createElement("div");
+      if (r.allowSpectators) {
+        const watch = document.createElement("button");
+        watch.className = "btn";
+        watch.textContent = "观战";
+        watch.onclick = () => request("room_join", { roomId: r.id, spectate: true }); // @BE
+        actions.appendChild(watch);
+      }
+      actions.appendChild(btn);
+      item.appendChild(actions);
       roomsList.appendChild(item);
     });
 }
@@ -396,7 +629,11 @@ function renderRooms() {
 function renderRoom() {
   if (!app.room) return;
   roomTitle.textContent = `房间：${app.room.name}`;
-  roomMeta.textContent = `房间ID: ${app.room.id} ｜ 房主: ${app.room.hostId === app.userId ? "你" : app.room.hostId}`;
+  roomMeta.textContent =
+    `房间ID: ${app.room.id} ｜ 房主: ${app.room.hostId === app.userId ? "你" : app.room.hostId}` +
+    ` ｜ 人数: ${(app.room.players || []).length}/${app.room.maxPlayers || "-"}` +
+    (app.room.hasPassword ? " ｜ 🔒 有密码" : "") +
+    (app.room.private ? " ｜ 私密" : "");
   playersList.innerHTML = "";
 
   const players = app.room.players || [];
@@ -411,21 +648,48 @@ function renderRoom() {
     avatar.className = "avatar";
     const name = document.createElement("div");
     name.textContent = p.name + (p.id === app.userId ? "（你）" : "");
+    if (app.room.winnerId) {
+      // @BE: scores of the last match, kept until the next start
+      name.textContent += `${p.id === app.room.winnerId ? " 👑" : ""} ｜ 上局击杀 ${p.score || 0}`;
+    }
     left.appendChild(avatar);
     left.appendChild(name);
 
     const badge = document.createElement("div");
     badge.className = "badge " + (p.ready ? "ready" : "");
     badge.textContent = p.ready ? "已准备" : "未准备";
+    if (p.afk) badge.textContent += " · 挂机";
 
     row.appendChild(left);
     row.appendChild(badge);
+    appendHostActions(row, p, true);
+    playersList.appendChild(row);
+  });
+  (app.room.spectators || []).forEach((s) => {
+    // @BE: spectators are listed separately from players
+    const row = document.createElement("div");
+    row.className = "playerRow";
+    const left = document.createElement("div");
+    left.className = "left";
+    const avatar = document.createElement("div");
+    avatar.className = "avatar";
+    const name = document.createElement("div");
+    name.textContent = s.name + (s.id === app.userId ? "（你）" : "");
+    left.appendChild(avatar);
+    left.appendChild(name);
+    const badge = document.createElement("div");
+    badge.className = "badge";
+    badge.textContent = "观战";
+    row.appendChild(left);
+    row.appendChild(badge);
+    appendHostActions(row, s, false);
     playersList.appendChild(row);
   });
 
   const me = players.find((p) => p.id === app.userId);
   const ready = !!(me && me.ready);
   readyBtn.textContent = ready ? "取消准备" : "准备";
+  readyBtn.disabled = isSpectating();
   startBtn.disabled = app.room.hostId !== app.userId;
 
   const isHost = app.room.hostId === app.userId;
@@ -438,12 +702,22 @@ function renderRoom() {
   if (!app.roomDraft.dirty) {
     app.roomDraft.winScore = ws;
     app.roomDraft.showEnemiesOnMap = showEnemies;
+    app.roomDraft.maxPlayers = clampInt(Number(app.room.maxPlayers || 8), 2, 16);
+    app.roomDraft.private = !!app.room.private;
+    app.roomDraft.allowLateJoin = !!app.room.allowLateJoin;
+    app.roomDraft.allowSpectators = !!app.room.allowSpectators;
     app.roomDraft.wallText = wallText;
   }
 
   const active = document.activeElement;
   const editing =
-    active === winScoreInput || active === wallTextInput || active === showEnemiesOnMapToggle;
+    active === winScoreInput ||
+    active === wallTextInput ||
+    active === showEnemiesOnMapToggle ||
+    active === maxPlayersInput ||
+    active === privateToggle ||
+    active === allowLateJoinToggle ||
+    active === allowSpectatorsToggle;
 
   if (winScoreInput) {
     if (!editing || !isHost) winScoreInput.value = String(app.roomDraft.winScore);
@@ -453,12 +727,56 @@ function renderRoom() {
     if (!editing || !isHost) showEnemiesOnMapToggle.checked = !!app.roomDraft.showEnemiesOnMap;
     showEnemiesOnMapToggle.disabled = !isHost;
   }
+  if (maxPlayersInput) {
+    if (!editing || !isHost) maxPlayersInput.value = String(app.roomDraft.maxPlayers);
+    maxPlayersInput.disabled = !isHost;
+  }
+  if (privateToggle) {
+    if (!editing || !isHost) privateToggle.checked = !!app.roomDraft.private;
+    privateToggle.disabled = !isHost;
+  }
+  if (allowLateJoinToggle) {
+    if (!editing || !isHost) allowLateJoinToggle.checked = !!app.roomDraft.allowLateJoin;
+    allowLateJoinToggle.disabled = !isHost;
+  }
+  if (allowSpectatorsToggle) {
+    if (!editing || !isHost) allowSpectatorsToggle.checked = !!app.roomDraft.allowSpectators;
+    allowSpectatorsToggle.disabled = !isHost;
+  }
   if (wallTextInput) {
     if (!editing || !isHost) wallTextInput.value = app.roomDraft.wallText;
     wallTextInput.disabled = !isHost;
   }
 }
 
+// appendHostActions adds the host's moderation buttons to a member row.
+function appendHostActions(row, member, isPlayer) {
+  if (!app.room || app.room.hostId !== app.userId || member.id === app.userId) return;
+  const actions = [
+    isPlayer && !member.disconnected && ["转让房主", "room_transfer_host", `把房主转让给 ${member.name}？`],
+    ["踢出", "room_kick", ""],
+    ["封禁", "room_ban", `封禁 ${member.name}？本房间内无法再加入。`],
+  ];
+  actions.filter(Boolean).forEach(([label, type, confirmText]) => {
+    const btn = document.createElement("button");
+    btn.className = "btn" + (type === "room_ban" ? " danger" : "");
+    btn.textContent = label;
+    btn.onclick = () => {
+      if (confirmText && !confirm(confirmText)) return;
+      request(type, { userId: member.id }); // @BE: host moderation
+    };
+    row.appendChild(btn);
+  });
+}
+
+function isSpectating() {
+  return !!(app.room && (app.room.spectators || []).some((s) => s.id === app.userId));
+}
+
+function isAfk() {
+  return !!(app.room && (app.room.players || []).some((p) => p.id === app.userId && p.afk));
+}
+
 function escapeHTML(s) {
   return String(s).replace(/[&<>"']/g, (c) => ({ "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c]));
 }
@@ -473,7 +791,11 @@ loginBtn.onclick = () => {
 };
 
 createRoomBtn.onclick = () => {
-  send("room_create", { name: roomNameInput.value.trim() }); // @BE
+  request("room_create", {
+    name: roomNameInput.value.trim(),
+    password: roomPasswordInput ? roomPasswordInput.value.trim() : "",
+    private: !!(roomPrivateToggle && roomPrivateToggle.checked),
+  }); // @BE
 };
 
 refreshRoomsBtn.onclick = () => {
@@ -489,7 +811,7 @@ copyMeBtn.onclick = async () => {
 joinRoomBtn.onclick = () => {
   const id = (joinRoomIdInput.value || "").trim();
   if (!id) return;
-  send("room_join", { roomId: id }); // @BE
+  request("room_join", { roomId: id }); // @BE
 };
 
 leaveRoomBtn.onclick = () => {
@@ -512,10 +834,15 @@ copyInviteBtn.onclick = async () => {
 readyBtn.onclick = () => {
   if (!app.room) return;
   const me = (app.room.players || []).find((p) => p.id === app.userId);
-  send("room_ready", { ready: !(me && me.ready) }); // @BE
+  request("room_ready", { ready: !(me && me.ready) }); // @BE
 };
 
 function leaveToLobby() {
+  if (app.replay) {
+    // a replay has no lobby: back to the normal page
+    location.href = location.pathname;
+    return;
+  }
   stopGameLoops();
   closeMenu();
   send("room_leave", {}); // @BE
@@ -535,7 +862,9 @@ startBtn.onclick = () => {
   const winScore = clampInt(Number(winScoreInput ? winScoreInput.value : 10), 1, 50);
   const showEnemiesOnMap = !!(showEnemiesOnMapToggle ? showEnemiesOnMapToggle.checked : true);
   const wallText = (wallTextInput ? wallTextInput.value : "").trim();
-  send("room_start", { winScore, showEnemiesOnMap, wallText }); // @BE
+  const allowLateJoin = !!(allowLateJoinToggle && allowLateJoinToggle.checked);
+  const allowSpectators = !!(allowSpectatorsToggle && allowSpectatorsToggle.checked);
+  request("room_start", { winScore, showEnemiesOnMap, wallText, allowLateJoin, allowSpectators }); // @BE
 };
 
 function scheduleRoomConfigUpdate() {
@@ -548,9 +877,13 @@ function scheduleRoomConfigUpdate() {
     const payload = {
       winScore: clampInt(app.roomDraft.winScore, 1, 50),
       showEnemiesOnMap: !!app.roomDraft.showEnemiesOnMap,
+      maxPlayers: clampInt(app.roomDraft.maxPlayers, 2, 16),
+      private: !!app.roomDraft.private,
+      allowLateJoin: !!app.roomDraft.allowLateJoin,
+      allowSpectators: !!app.roomDraft.allowSpectators,
       wallText: String(app.roomDraft.wallText || "").trim(),
     };
-    send("room_config", payload); // @BE
+    request("room_config", payload); // @BE
     app.roomDraft.dirty = false;
   }, 250);
 }
@@ -567,6 +900,30 @@ if (showEnemiesOnMapToggle) {
     scheduleRoomConfigUpdate();
   });
 }
+if (maxPlayersInput) {
+  maxPlayersInput.addEventListener("input", () => {
+    app.roomDraft.maxPlayers = clampInt(Number(maxPlayersInput.value || 8), 2, 16);
+    scheduleRoomConfigUpdate();
+  });
+}
+if (privateToggle) {
+  privateToggle.addEventListener("change", () => {
+    app.roomDraft.private = !!privateToggle.checked;
+    scheduleRoomConfigUpdate();
+  });
+}
+if (allowLateJoinToggle) {
+  allowLateJoinToggle.addEventListener("change", () => {
+    app.roomDraft.allowLateJoin = !!allowLateJoinToggle.checked;
+    scheduleRoomConfigUpdate();
+  });
+}
+if (allowSpectatorsToggle) {
+  allowSpectatorsToggle.addEventListener("change", () => {
+    app.roomDraft.allowSpectators = !!allowSpectatorsToggle.checked;
+    scheduleRoomConfigUpdate();
+  });
+}
 if (wallTextInput) {
   wallTextInput.addEventListener("input", () => {
     app.roomDraft.wallText = String(wallTextInput.value || "").slice(0, 24);
@@ -822,6 +1179,11 @@ function startGameLoops() {
   resizeCanvas();
 
   app.sendTimer = setInterval(() => {
+    if (app.snapAck) {
+      send("state_ack", { tick: app.snapAck }); // @BE: lets the backend send deltas against it
+      app.snapAck = 0;
+    }
+    if (isSpectating()) return; // the backend ignores spectator input
     const turn = app.input.turnAccum;
     app.input.turnAccum = 0;
     const shoot = app.input.shootEdge;
@@ -833,14 +1195,22 @@ function startGameLoops() {
       spawnParticles("shot");
       playSfx("shot");
     }
-    send("input", { // @BE: per-tick input upload
+    const input = {
+      seq: ++app.predict.seq,
       forward: app.input.forward,
       back: app.input.back,
       left: app.input.left,
       right: app.input.right,
       turn,
       shoot,
-    });
+      // @BE: the snapshot on screen; the backend tests our shot against where the enemies were then
+      viewTick: shoot && app.gameState ? app.gameState.tick : 0,
+    };
+    send("input", input); // @BE: per-tick input upload, acked via game_state players[].ack
+    app.predict.pending.push(input);
+    if (app.predict.pending.length > 64) app.predict.pending.shift();
+    const me = selfFrame();
+    if (me) predictStep(me, input);
   }, app.tickMs);
 
   app.raf = requestAnimationFrame(renderFrame);
@@ -853,6 +1223,20 @@ function stopGameLoops() {
   app.raf = 0;
 }
 
+// spectateTarget is the player a spectator's camera follows.
+function spectateTarget() {
+  if (!isSpectating()) return null;
+  const players = app.gameState.players || [];
+  return players.find((p) => p.id === app.spectate.targetId) || players[0] || null;
+}
+
+function cycleSpectateTarget() {
+  const players = (app.gameState && app.gameState.players) || [];
+  if (!players.length) return;
+  const i = players.findIndex((p) => p.id === app.spectate.targetId);
+  app.spectate.targetId = players[(i + 1) % players.length].id;
+}
+
 function renderFrame() {
   app.raf = requestAnimationFrame(renderFrame);
   const ctx = gameCanvas.getContext("2d");
@@ -861,10 +1245,10 @@ function renderFrame() {
     return;
   }
 
-  const me = (app.gameState.players || []).find((p) => p.id === app.userId);
+  const me = (app.gameState.players || []).find((p) => p.id === app.userId) || spectateTarget();
   if (!me) return;
 
-  hudName.textContent = `玩家：${me.name}`;
+  hudName.textContent = isSpectating() ? `观战：${me.name}（点击切换）` : `玩家：${me.name}`;
   hudHP.textContent = `HP：${me.hp}`;
   hudScore.textContent = `击杀：${me.score}`;
   if (hudPing) hudPing.textContent = app.net.pingMs ? `Ping：${app.net.pingMs}ms` : "Ping：-";
@@ -1582,7 +1966,7 @@ function sendChat() {
   if (!chatInput) return;
   const text = (chatInput.value || "").trim();
   if (!text) return;
-  send("chat_send", { text }); // @BE
+  request("chat_send", { text }); // @BE
   chatInput.value = "";
 }
 
@@ -1659,6 +2043,82 @@ function isWall(mapRows, x, y) {
   return mapRows[y][x] === "#";
 }
 
+function onSnapshot(state) {
+  app.snaps.set(state.tick, state);
+  for (const tick of app.snaps.keys()) {
+    if (tick < state.tick - 64) app.snaps.delete(tick);
+  }
+  app.snapAck = state.tick;
+
+  // render a copy: names come from room_state, and prediction moves our own player
+  const names = new Map(((app.room && app.room.players) || []).map((p) => [p.id, p.name]));
+  app.gameState = {
+    tick: state.tick,
+    players: (state.players || []).map((p) => ({ ...p, name: p.name || names.get(p.id) || p.id })),
+  };
+  reconcileSelf();
+  updateFxFromState();
+}
+
+function applyDelta(base, delta) {
+  const removed = new Set(delta.removed || []);
+  const players = new Map();
+  for (const p of base.players || []) {
+    if (!removed.has(p.id)) players.set(p.id, p);
+  }
+  for (const d of delta.players || []) {
+    players.set(d.id, { ...(players.get(d.id) || {}), ...d });
+  }
+  return { tick: delta.tick, players: [...players.values()] };
+}
+
+function selfFrame() {
+  return ((app.gameState && app.gameState.players) || []).find((p) => p.id === app.userId);
+}
+
+// reconcileSelf replaces our own position in a fresh game_state with the
+// server's, plus the inputs it has not applied yet (seq > ack).
+function reconcileSelf() {
+  const me = selfFrame();
+  if (!me) return;
+  const ack = me.ack || 0;
+  app.predict.pending = app.predict.pending.filter((inp) => inp.seq > ack);
+  for (const inp of app.predict.pending) predictStep(me, inp);
+}
+
+// predictStep mirrors one backend tick for our own player: the turn and
+// move() in Simulation.Step, backend/internal/game/simulation.go.
+function predictStep(p, input) {
+  const rows = app.map && app.map.rows;
+  if (!rows) return;
+  const wall = (x, y) => isWall(rows, Math.trunc(x), Math.trunc(y));
+  p.dir = normalizeAngle(p.dir + input.turn);
+  const speed = 0.08;
+  let dx = 0;
+  let dy = 0;
+  if (input.forward) {
+    dx += Math.cos(p.dir) * speed;
+    dy += Math.sin(p.dir) * speed;
+  }
+  if (input.back) {
+    dx -= Math.cos(p.dir) * speed;
+    dy -= Math.sin(p.dir) * speed;
+  }
+  if (input.left) {
+    dx += Math.cos(p.dir - Math.PI / 2) * speed;
+    dy += Math.sin(p.dir - Math.PI / 2) * speed;
+  }
+  if (input.right) {
+    dx += Math.cos(p.dir + Math.PI / 2) * speed;
+    dy += Math.sin(p.dir + Math.PI / 2) * speed;
+  }
+  const radius = 0.18;
+  const nx = p.x + dx;
+  if (!wall(nx + radius, p.y) && !wall(nx - radius, p.y)) p.x = nx;
+  const ny = p.y + dy;
+  if (!wall(p.x, ny + radius) && !wall(p.x, ny - radius)) p.y = ny;
+}
+
 function normalizeAngle(a) {
   while (a < -Math.PI) a += Math.PI * 2;
   while (a > Math.PI) a -= Math.PI * 2;
@@ -1680,12 +2140,70 @@ function clampInt(n, min, max) {
   return Math.max(min, Math.min(max, x));
 }
 
+// ---- Replay ----
+
+// startReplay watches a recording instead of playing: the replay server
+// streams it like a match we spectate (room_state, game_start, game_state,
+// game_over) and takes replay_control to change speed, pause and seek.
+function startReplay(id) {
+  app.replay = { id, speed: 1, paused: false, tick: 0, ticks: 0 };
+  app.wsUrl = `${app.replayUrl}?id=${encodeURIComponent(id)}`;
+  connectAndHello("回放观众");
+}
+
+function onReplayInfo(info) {
+  // @BE: sent when the stream starts and after every replay_control
+  if (!app.replay) return;
+  const first = !app.replay.ticks;
+  Object.assign(app.replay, info);
+  if (first) {
+    toastMsg("回放：1/2 切换倍速，空格暂停，←/→ 后退/前进 5 秒");
+    return;
+  }
+  const state = info.paused ? "已暂停" : `${info.speed}×`;
+  toastMsg(`回放 ${state} ｜ ${formatTicks(info.tick)} / ${formatTicks(info.ticks)}`);
+}
+
+// replayKey handles the replay controls; it returns false for other keys.
+function replayKey(e) {
+  const tick = app.gameState ? app.gameState.tick : app.replay.tick;
+  const step = Math.round(5000 / app.tickMs);
+  switch (e.code) {
+    case "Digit1":
+      send("replay_control", { speed: 1 }); // @BE
+      return true;
+    case "Digit2":
+      send("replay_control", { speed: 2 }); // @BE
+      return true;
+    case "Space":
+      send("replay_control", { paused: !app.replay.paused }); // @BE
+      return true;
+    case "ArrowLeft":
+      send("replay_control", { seek: Math.max(0, tick - step) }); // @BE: the server re-simulates from the start
+      return true;
+    case "ArrowRight":
+      send("replay_control", { seek: Math.min(app.replay.ticks, tick + step) }); // @BE
+      return true;
+    default:
+      return false;
+  }
+}
+
+function formatTicks(ticks) {
+  const s = Math.floor((ticks * app.tickMs) / 1000);
+  return `${Math.floor(s / 60)}:${String(s % 60).padStart(2, "0")}`;
+}
+
 // ---- Controls ----
 
 document.addEventListener("keydown", (e) => {
   if (isTyping()) {
     return;
   }
+  if (app.replay && replayKey(e)) {
+    e.preventDefault();
+    return;
+  }
   if (e.code === "Escape") {
     if (screenGame.classList.contains("hidden")) return;
     e.preventDefault();
@@ -1735,6 +2253,10 @@ function lockPointer() {
 }
 
 gameCanvas.addEventListener("click", () => {
+  if (isSpectating()) {
+    cycleSpectateTarget();
+    return;
+  }
   lockPointer();
 });
 
@@ -1818,8 +2340,18 @@ function renderGameOver() {
   const winScore = p.winScore || app.match.winScore || 10;
   const roomName = p.roomName || (app.room && app.room.name) || "对局";
 
-  if (gameOverTitle) gameOverTitle.textContent = "对局结束";
-  if (gameOverSub) gameOverSub.textContent = `胜利条件：先到 ${winScore} 击杀 ｜ 房间：${roomName}`;
+  if (gameOverTitle) gameOverTitle.textContent = p.reason === "server_shutdown" ? "对局结束（服务器维护）" : "对局结束";
+  const returnIn = p.returnAt ? Math.max(0, Math.round((p.returnAt - Date.now()) / 1000)) : 0;
+  if (gameOverSub) {
+    gameOverSub.textContent =
+      `胜利条件：先到 ${winScore} 击杀 ｜ 房间：${roomName}` +
+      (returnIn ? ` ｜ ${returnIn} 秒后回到房间` : "") +
+      (p.recordingId ? ` ｜ 回放：${p.recordingId}` : "");
+  }
+  // @BE: recordingId is only set when the backend records matches (-record-dir)
+  if (gameOverReplayBtn) gameOverReplayBtn.classList.toggle("hidden", !p.recordingId || !!app.replay);
+  if (gameOverRematchBtn) gameOverRematchBtn.classList.toggle("hidden", !!app.replay);
+  if (gameOverLeaveBtn) gameOverLeaveBtn.textContent = app.replay ? "退出回放" : "退出到大厅";
 
   const winner = rankings.find((x) => x.id === winnerId) || rankings[0];
   const winnerName = winner ? winner.name : "某位神秘玩家";
@@ -1919,9 +2451,18 @@ if (gameMenu) {
   });
 }
 
+if (gameOverRematchBtn) {
+  gameOverRematchBtn.onclick = () => request("room_rematch", {}); // @BE
+}
 if (gameOverLeaveBtn) {
   gameOverLeaveBtn.onclick = () => leaveToLobby();
 }
+if (gameOverReplayBtn) {
+  gameOverReplayBtn.onclick = () => {
+    const id = app.match.overPayload && app.match.overPayload.recordingId;
+    if (id) window.open(`${location.origin}${location.pathname}?replay=${encodeURIComponent(id)}`, "_blank");
+  };
+}
 if (gameOverCloseBtn) {
   gameOverCloseBtn.onclick = () => {
     closeGameOver();
@@ -1940,3 +2481,7 @@ const params = parseParams();
 if (params.room) {
   app.pendingRoomJoin = params.room;
 }
+// replay link: watch a recorded match, no login needed
+if (params.replay) {
+  startReplay(params.replay);
+}